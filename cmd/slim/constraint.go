@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/build/constraint"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+  Finds the directories (relative to the project root) of changed go files
+  whose build constraints differ between the old and new side of the
+  comparison, as read by readOld and readNew. Only files that are constrained
+  after the change are checked, since an unconstrained file can't make its
+  package unbuildable.
+*/
+func constraintChanges(diffs StringSet, readOld, readNew fileReader, projectDir string) StringSet {
+	dirs := StringSet{}
+	for _, file := range diffs.SortedSlice() {
+		if !strings.HasSuffix(file, ".go") {
+			continue
+		}
+		newSrc, ok := readNew(file)
+		if !ok {
+			continue // deleted
+		}
+		newExpr := buildConstraint(newSrc)
+		if newExpr == "" {
+			continue
+		}
+		oldSrc, _ := readOld(file)
+		if oldExpr := buildConstraint(oldSrc); oldExpr != newExpr {
+			logEvent(Event{Kind: eventConstraint, Path: file, Reason: fmt.Sprintf("%q -> %q", oldExpr, newExpr)})
+			dirs.Add(fileDir(projectDir, file))
+		}
+	}
+	return dirs
+}
+
+// Reads a file (relative to the project root) from one side of a comparison, reporting false if it doesn't exist there.
+type fileReader func(file string) ([]byte, bool)
+
+/*
+  Reads files at a git revision, where an empty rev means the working tree.
+  The go files among files are read from git up front, in one pass, since
+  they're the ones that get compared.
+*/
+func revisionReader(rev string, files StringSet, projectDir string) fileReader {
+	if rev == "" {
+		return dirReader(projectDir)
+	}
+	var goFiles []string
+	for _, file := range files.SortedSlice() {
+		if strings.HasSuffix(file, ".go") {
+			goFiles = append(goFiles, file)
+		}
+	}
+	blobs, err := gitBlobs(rev, goFiles)
+	check(err)
+	return func(file string) ([]byte, bool) {
+		src, ok := blobs[file]
+		return src, ok
+	}
+}
+
+// Reads files beneath dir.
+func dirReader(dir string) fileReader {
+	return func(file string) ([]byte, bool) {
+		src, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		return src, err == nil
+	}
+}
+
+/*
+  Returns the normalized build constraint expression of a go source file, or ""
+  if it has none. Both //go:build and legacy // +build lines are understood.
+*/
+func buildConstraint(src []byte) string {
+	var plusBuild []constraint.Expr
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			continue
+		}
+		if constraint.IsGoBuild(line) {
+			return expr.String()
+		}
+		plusBuild = append(plusBuild, expr)
+	}
+	if len(plusBuild) == 0 {
+		return ""
+	}
+	expr := plusBuild[0]
+	for _, x := range plusBuild[1:] {
+		expr = &constraint.AndExpr{X: expr, Y: x}
+	}
+	return expr.String()
+}
+
+// Removes the given dirs from paths when none of their go files build in the current build context.
+func removeUnbuildable(paths, dirs StringSet, projectDir string) {
+	fsys := os.DirFS(projectDir)
+	for dir := range dirs {
+		if paths.Exists(dir) && !matchesBuildContext(fsys, dir) {
+			logEvent(Event{Kind: eventPruned, Path: dir, Reason: "no go files match the build constraints"})
+			paths.Del(dir)
+		}
+	}
+}
+
+/*
+  Reports whether any go file directly in dir (relative to the root of fsys)
+  builds with the default build context. MatchFile only opens the file it's
+  given, so its OpenFile hook is all that's needed to read from fsys too.
+*/
+func matchesBuildContext(fsys fs.FS, dir string) bool {
+	dir = filepath.ToSlash(dir)
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return false
+	}
+	ctxt := build.Default
+	ctxt.JoinPath = path.Join
+	ctxt.OpenFile = func(name string) (io.ReadCloser, error) {
+		return fsys.Open(name)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".go") {
+			continue
+		}
+		if match, err := ctxt.MatchFile(dir, entry.Name()); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  Returns the build tags that must be passed to go test -tags for it to
+  compile the test file (relative to the project root), joined by commas, eg:
+  "integration". Returns "" for test files compiled without extra tags, and
+  for files that no longer exist.
+*/
+func testTags(projectDir, file string) string {
+	dir, name := filepath.Split(filepath.Join(projectDir, file))
+	if match, err := build.Default.MatchFile(dir, name); err != nil || match {
+		return ""
+	}
+	src, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	expr, err := constraint.Parse("//go:build " + buildConstraint(src))
+	if err != nil {
+		return ""
+	}
+	tags := StringSet{}
+	var collect func(expr constraint.Expr, negated bool)
+	collect = func(expr constraint.Expr, negated bool) {
+		switch x := expr.(type) {
+		case *constraint.TagExpr:
+			if !negated && !tagSatisfied(x.Tag) {
+				tags.Add(x.Tag)
+			}
+		case *constraint.NotExpr:
+			collect(x.X, !negated)
+		case *constraint.AndExpr:
+			collect(x.X, negated)
+			collect(x.Y, negated)
+		case *constraint.OrExpr:
+			collect(x.X, negated)
+			collect(x.Y, negated)
+		}
+	}
+	collect(expr, false)
+	return strings.Join(tags.SortedSlice(), ",")
+}
+
+// Reports whether the build tag is already satisfied by the current build context.
+func tagSatisfied(tag string) bool {
+	ctx := build.Default
+	if tag == ctx.GOOS || tag == ctx.GOARCH || tag == ctx.Compiler || tag == "cgo" && ctx.CgoEnabled {
+		return true
+	}
+	for _, t := range concat(ctx.BuildTags, ctx.ToolTags, ctx.ReleaseTags) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+/*
+  Finds the changed go files (relative to the project root) whose edits only
+  touch comments and whitespace, as read by readOld and readNew. Such files
+  compile to the same program, so with -ignore-comment-changes they don't impact
+  their package. Files are compared whole, not declaration by declaration, so
+  any code change counts, even to a declaration that nothing uses. Added,
+  deleted and unparseable files always count as changed.
+*/
+func cosmeticChanges(diffs StringSet, readOld, readNew fileReader) StringSet {
+	cosmetic := StringSet{}
+	for _, file := range diffs.SortedSlice() {
+		if !strings.HasSuffix(file, ".go") {
+			continue
+		}
+		oldSrc, ok := readOld(file)
+		if !ok {
+			continue
+		}
+		newSrc, ok := readNew(file)
+		if !ok {
+			continue
+		}
+		oldTokens, ok := goTokens(oldSrc)
+		if !ok {
+			continue
+		}
+		newTokens, ok := goTokens(newSrc)
+		if !ok {
+			continue
+		}
+		if reflect.DeepEqual(oldTokens, newTokens) {
+			cosmetic.Add(file)
+		}
+	}
+	return cosmetic
+}
+
+/*
+  Returns the tokens of a go source file as the compiler sees them, so two
+  files with the same tokens differ only in formatting and comments. Comments
+  that are directives to the toolchain (//go:build, //go:embed, //export, ...)
+  are kept as tokens, and so is every comment in cgo files, whose preamble is C
+  code. Reports false if the file doesn't scan.
+*/
+func goTokens(src []byte) ([]string, bool) {
+	keepComments := bytes.Contains(src, []byte(`"C"`))
+
+	fset := token.NewFileSet()
+	var s scanner.Scanner
+	var failed bool
+	s.Init(fset.AddFile("", fset.Base(), len(src)), src, func(token.Position, string) { failed = true }, scanner.ScanComments)
+
+	var tokens []string
+	for {
+		_, tok, lit := s.Scan()
+		switch {
+		case tok == token.EOF:
+			return tokens, !failed
+		case tok == token.COMMENT && !keepComments && !isDirective(lit):
+			continue
+		case tok == token.SEMICOLON:
+			lit = ";" // "\n" when inserted automatically
+		case (tok == token.RBRACE || tok == token.RPAREN) && len(tokens) > 0 && tokens[len(tokens)-1] == "; ;":
+			// A semicolon before a closing ) or } is optional, so "{ f() }" and "{\n\tf()\n}" are the same code
+			tokens = tokens[:len(tokens)-1]
+		}
+		tokens = append(tokens, tok.String()+" "+lit)
+	}
+}
+
+func isDirective(comment string) bool {
+	for _, prefix := range []string{"//go:", "// +build", "//export ", "//line "} {
+		if strings.HasPrefix(comment, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGoTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "comments dropped",
+			src:    "// Package a.\npackage a // trailing\n\n/* block */\nvar x = 1\n",
+			want:   []string{"package package", "IDENT a", "; ;", "var var", "IDENT x", "= ", "INT 1", "; ;"},
+			wantOK: true,
+		},
+		{
+			name:   "directives kept",
+			src:    "//go:build linux\n\npackage a\n\n//go:embed x.txt\nvar x string\n",
+			want:   []string{"COMMENT //go:build linux", "package package", "IDENT a", "; ;", "COMMENT //go:embed x.txt", "var var", "IDENT x", "IDENT string", "; ;"},
+			wantOK: true,
+		},
+		{
+			name:   "cgo preamble kept",
+			src:    "package a\n\n// #include <stdio.h>\nimport \"C\"\n",
+			want:   []string{"package package", "IDENT a", "; ;", "COMMENT // #include <stdio.h>", "import import", "STRING \"C\"", "; ;"},
+			wantOK: true,
+		},
+		{
+			name:   "explicit and inserted semicolons",
+			src:    "package a; var x = 1;\n",
+			want:   []string{"package package", "IDENT a", "; ;", "var var", "IDENT x", "= ", "INT 1", "; ;"},
+			wantOK: true,
+		},
+		{
+			name:   "doesn't scan",
+			src:    "package a\n\nvar x = \"unterminated\n",
+			wantOK: false,
+		},
+	}
+	for _, test := range tests {
+		got, ok := goTokens([]byte(test.src))
+		if ok != test.wantOK || (test.wantOK && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("%s: goTokens(%q) = %q, %v, want %q, %v", test.name, test.src, got, ok, test.want, test.wantOK)
+		}
+	}
+
+	// Reformatting, and semicolons written out where they'd be inserted, leave the tokens as they were
+	a, _ := goTokens([]byte("package a\n\nfunc f() {\n\tx := 1\n\t_ = x\n}\n"))
+	b, _ := goTokens([]byte("package a; func f() { x := 1; _ = x }"))
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("reformatted tokens differ:\n%q\n%q", a, b)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+  Determines which files differ between two directory trees, for when there is
+  no git history to diff (eg: a CI job that restores a snapshot of the base
+  checkout). A file differs if it exists on only one side, or if its contents
+  differ. Files with the same size and modification time on both sides are
+  assumed unchanged without reading them. Returns paths relative to headDir,
+  using forward slashes like git. .git directories are skipped.
+*/
+func dirDifference(baseDir, headDir string) (StringSet, error) {
+	base, err := walkFiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := walkFiles(headDir)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := StringSet{}
+	for file, headInfo := range head {
+		baseInfo, ok := base[file]
+		if !ok {
+			diffs.Add(file)
+			continue
+		}
+		same, err := sameFile(filepath.Join(baseDir, file), baseInfo, filepath.Join(headDir, file), headInfo)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			diffs.Add(file)
+		}
+	}
+	for file := range base {
+		if _, ok := head[file]; !ok {
+			diffs.Add(file) // deleted
+		}
+	}
+	return diffs, nil
+}
+
+// Lists the regular files beneath dir, keyed by their slash separated path relative to dir.
+func walkFiles(dir string) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return files, err
+}
+
+func sameFile(basePath string, baseInfo os.FileInfo, headPath string, headInfo os.FileInfo) (bool, error) {
+	if baseInfo.Size() != headInfo.Size() {
+		return false, nil
+	}
+	if baseInfo.ModTime().Equal(headInfo.ModTime()) {
+		return true, nil
+	}
+	baseSum, err := fileHash(basePath)
+	if err != nil {
+		return false, err
+	}
+	headSum, err := fileHash(headPath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(baseSum, headSum), nil
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDirDifference(t *testing.T) {
+	baseDir, headDir := t.TempDir(), t.TempDir()
+	writeFiles(t, baseDir, map[string]string{
+		"deleted.go":    "package a\n",
+		"changed.go":    "package a // aaaa\n",
+		"touched.go":    "package a\n",
+		"shortcut.go":   "package a // aaaa\n",
+		"resized.go":    "package a\n",
+		"sub/nested.go": "package sub // aaaa\n",
+		".git/HEAD":     "ref: refs/heads/main\n",
+	})
+	writeFiles(t, headDir, map[string]string{
+		"added.go":      "package a\n",
+		"changed.go":    "package a // bbbb\n", // same size, other content
+		"touched.go":    "package a\n",         // same content, other mtime
+		"shortcut.go":   "package a // bbbb\n", // same size and mtime, so not read
+		"resized.go":    "package a\n\n",
+		"sub/nested.go": "package sub // bbbb\n",
+		".git/HEAD":     "ref: refs/heads/other\n",
+	})
+
+	// Every file gets its own mtime, except shortcut.go, whose mtimes match on both sides
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, file := range []string{"changed.go", "touched.go", "resized.go", "sub/nested.go"} {
+		setMtime(t, filepath.Join(baseDir, file), then.Add(time.Duration(i)*time.Minute))
+		setMtime(t, filepath.Join(headDir, file), then.Add(time.Duration(i)*time.Minute+time.Second))
+	}
+	setMtime(t, filepath.Join(baseDir, "shortcut.go"), then)
+	setMtime(t, filepath.Join(headDir, "shortcut.go"), then)
+
+	diffs, err := dirDifference(baseDir, headDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"added.go", "changed.go", "deleted.go", "resized.go", "sub/nested.go"}
+	if got := diffs.SortedSlice(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dirDifference = %q, want %q", got, want)
+	}
+}
+
+// Sets both the access and modification times of path.
+func setMtime(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
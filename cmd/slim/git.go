@@ -2,9 +2,33 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
+var (
+	errGitNotFound    = errors.New("git executable not found in PATH: slim needs git to discover changed files")
+	errNotARepository = errors.New("not a git repository: run slim from inside the project's work tree")
+	errGitFailed      = errors.New("git failed") // wraps the failures of git commands, see shell
+)
+
+// Reports whether git can be run at all from the current directory, before any diffing is attempted.
+func gitCheck() error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return errGitNotFound
+	}
+	if err := exec.Command("git", gitArgs("rev-parse", "--is-inside-work-tree")...).Run(); err != nil {
+		return errNotARepository
+	}
+	return nil
+}
+
 /*
   Determines which files in the project have changed, according to Git.
   Returns a slice of filenames relative to the project root and any error from
@@ -31,16 +55,17 @@ import (
       one side is omitted, it will have the same effect as using HEAD instead.
         git diff --name-only <commit>...<commit>
 
+  A non-empty diffFilter is passed through to git diff as --diff-filter.
+  Untracked files count as added (A) for the purpose of the filter. Any
+  pathspecs are passed after "--" so git itself limits which files are listed.
+
   Any errors written by git will be reported to stderr. May return duplicates.
 */
-func gitAllDiffs(commitComparison string) StringSet {
-	commitComparison = strings.TrimSpace(commitComparison)
-	if commitComparison == "" {
-		commitComparison = "HEAD"
-	}
+func gitAllDiffs(commitComparison, diffFilter string, pathspecs []string) StringSet {
+	commitComparison = effectiveComparison(commitComparison)
 
 	// git diffs will return everything but untracked files
-	diffs := gitDiff(commitComparison)
+	diffs := gitDiff(commitComparison, diffFilter, pathspecs)
 
 	// If it's an explicit comparison, we don't care about untracked files
 	if strings.ContainsAny(commitComparison, " .") { // "sha1 sha2", "sha1..sha2", or "sha1...sha2"
@@ -48,43 +73,326 @@ func gitAllDiffs(commitComparison string) StringSet {
 	}
 
 	// If it's a single commit comparison (ie: HEAD, or HEAD~2), then we append untracked files
-	diffs.Merge(gitUntracked())
+	if diffFilterIncludes(diffFilter, 'A') {
+		diffs.Merge(gitUntracked(pathspecs))
+	}
 	return diffs
 }
 
+// Returns the commit comparison as it will be diffed, ie: trimmed and defaulting to HEAD.
+func effectiveComparison(commitComparison string) string {
+	if commitComparison = strings.TrimSpace(commitComparison); commitComparison == "" {
+		return "HEAD"
+	}
+	return commitComparison
+}
+
 /*
-  The output will look like this, where the first two characters
-  indicate the status, followed by a space, followed by the filename
-  relative to the project root:
+  Lists untracked files, similar to: git status --porcelain=v2 -z | grep "^?"
+  Git older than 2.11 doesn't have porcelain v2, so falls back to v1.
+*/
+func gitUntracked(pathspecs []string) StringSet {
+	args := []string{"status", "--untracked-files=all", "--porcelain=v2", "-z"}
+	parse := parsePorcelainV2
+	if !gitSupportsPorcelainV2() {
+		args = []string{"status", "--short", "--untracked-files=all", "--porcelain", "-z"}
+		parse = parsePorcelain
+	}
+	output := shell("git", gitArgs(withPathspecs(args, pathspecs)...)...)
 
-  D README.md
-  M  circle.yml
-  ?? foo.bar
-  ?? thjson/bar/baz/biz.txt
+	filenames := StringSet{}
+	for _, entry := range parse(output) {
+		if entry.status == "??" { // ?? means untracked
+			filenames.Add(entry.path)
+		}
+	}
+	return filenames
+}
 
-  So we parse the output similar to:
-    git status --short --untracked-files=all --porcelain | grep "??" | cut -c 4-
+// One file reported by git status --porcelain -z.
+type statusEntry struct {
+	status string // the two character XY code, eg: "M ", "R ", "??"
+	path   string // relative to the project root
+}
+
+/*
+  Parses the output of git status --porcelain -z (v1, for git older than
+  2.11; see parsePorcelainV2), where each entry is the XY
+  status, a space and the path, terminated by a NUL:
+
+    " M circle.yml\x00?? thjson/bar/baz/biz.txt\x00"
+
+  Renamed (R) and copied (C) entries are followed by the original path as a
+  separate NUL terminated field, rather than the "old -> new" arrow of the
+  human readable format:
+
+    "R  new.go\x00old.go\x00"
+
+  With -z paths are never quoted, so names containing spaces or arrows survive.
 */
-func gitUntracked() StringSet {
-	output := shell("git", "status", "--short", "--untracked-files=all", "--porcelain")
+func parsePorcelain(output []byte) []statusEntry {
+	fields := bytes.Split(output, []byte{0})
+	var entries []statusEntry
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if len(field) < 4 {
+			continue
+		}
+		entry := statusEntry{status: string(field[:2]), path: string(field[3:])}
+		if strings.ContainsAny(entry.status, "RC") {
+			i++ // skip the original path
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
 
-	filenames := StringSet{}
-	for _, file := range bytes.Split(output, []byte{'\n'}) {
-		if len(file) == 0 {
+/*
+  Parses the output of git status --porcelain=v2 -z, which is made for
+  machines: each record starts with its type and is NUL terminated.
+
+    "1 .M N... 100644 100644 100644 <hH> <hI> circle.yml\x00"   changed
+    "2 R. N... 100644 100644 100644 <hH> <hI> R100 new.go\x00old.go\x00"   renamed or copied
+    "u UU N... 100644 100644 100644 100644 <h1> <h2> <h3> both.go\x00"   unmerged
+    "? thjson/bar/baz/biz.txt\x00"   untracked
+    "! build/out.bin\x00"   ignored
+
+  The path is everything after a fixed number of space separated fields, so
+  names containing spaces survive. Statuses are reported in the v1 form, with
+  "." (unchanged) as a space and "??"/"!!" for untracked and ignored files.
+*/
+func parsePorcelainV2(output []byte) []statusEntry {
+	fields := bytes.Split(output, []byte{0})
+	var entries []statusEntry
+	for i := 0; i < len(fields); i++ {
+		record := string(fields[i])
+		var parts []string
+		switch {
+		case strings.HasPrefix(record, "1 "):
+			parts = strings.SplitN(record, " ", 9)
+		case strings.HasPrefix(record, "2 "):
+			parts = strings.SplitN(record, " ", 10)
+		case strings.HasPrefix(record, "u "):
+			parts = strings.SplitN(record, " ", 11)
+		case strings.HasPrefix(record, "? "):
+			entries = append(entries, statusEntry{status: "??", path: record[2:]})
 			continue
+		case strings.HasPrefix(record, "! "):
+			entries = append(entries, statusEntry{status: "!!", path: record[2:]})
+			continue
+		default:
+			continue // headers ("# ...") and blank trailing fields
 		}
-		if string(file[0:2]) != "??" { // ?? means untracked
+		if len(parts) < 9 {
 			continue
 		}
+		entry := statusEntry{status: strings.Replace(parts[1], ".", " ", -1), path: parts[len(parts)-1]}
+		if parts[0] == "2" {
+			i++ // skip the original path
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
 
-		filenames.Add(string(file[3:]))
+// Reports whether git is new enough (2.11+) for git status --porcelain=v2, going by git --version.
+func gitSupportsPorcelainV2() bool {
+	output, err := exec.Command("git", "--version").Output()
+	if err != nil {
+		return false
 	}
-	return filenames
+	// eg: "git version 2.39.2" or "git version 2.39.2.windows.1"
+	var major, minor int
+	fields := strings.Fields(string(output))
+	if len(fields) < 3 {
+		return false
+	}
+	if _, err := fmt.Sscanf(fields[2], "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 2 || major == 2 && minor >= 11
+}
+
+/*
+  Checks that every ref named in commitComparison (see gitAllDiffs) resolves to
+  a commit, so a typo is reported by name instead of as a raw git failure.
+  Omitted sides of ".." and "..." are not checked since git treats them as HEAD.
+
+  CI often checks out a shallow, detached HEAD where the base ref was never
+  fetched. With fetch, missing refs are fetched before giving up; otherwise the
+  error suggests how to fetch them.
+*/
+func gitVerifyComparison(commitComparison string, fetch bool) error {
+	var refs []string
+	for _, side := range strings.Fields(commitComparison) {
+		for _, ref := range strings.Split(strings.Replace(side, "...", "..", 1), "..") {
+			if ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	for _, ref := range refs {
+		if gitIsCommit(ref) || fetch && gitFetch(ref) && gitIsCommit(ref) {
+			continue
+		}
+		if gitIsShallow() {
+			return fmt.Errorf("unknown ref %q in -diff %q: this is a shallow clone, so it may not have been fetched. Run 'git fetch --unshallow' (or fetch the base ref), or pass -fetch-base", ref, commitComparison)
+		}
+		return fmt.Errorf("unknown ref %q in -diff %q: if it exists upstream, fetch it first (eg: 'git fetch origin main') or pass -fetch-base", ref, commitComparison)
+	}
+	return nil
+}
+
+func gitIsCommit(ref string) bool {
+	return exec.Command("git", gitArgs("rev-parse", "--verify", "--quiet", ref+"^{commit}")...).Run() == nil
+}
+
+func gitIsShallow() bool {
+	output, err := exec.Command("git", gitArgs("rev-parse", "--is-shallow-repository")...).Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
 }
 
-// git diff --name-only <commitPattern>
-func gitDiff(commitPattern string) StringSet {
-	output := shell("git", "diff", "--name-only", commitPattern)
+/*
+  Tries to fetch a missing ref, reporting whether git succeeded. Remote
+  tracking refs (eg: origin/main) are fetched from their remote. Otherwise a
+  shallow clone fetches the rest of origin's history, so commits like HEAD~1
+  resolve, and a full clone asks origin for the ref by name (eg: a sha).
+*/
+func gitFetch(ref string) bool {
+	var args []string
+	for _, remote := range strings.Fields(string(shell("git", gitArgs("remote")...))) {
+		if branch := strings.TrimPrefix(ref, remote+"/"); branch != ref {
+			args = []string{"fetch", "--no-tags", remote, "+refs/heads/" + branch + ":refs/remotes/" + remote + "/" + branch}
+			break
+		}
+	}
+	switch {
+	case args != nil:
+	case gitIsShallow():
+		args = []string{"fetch", "--no-tags", "--unshallow", "origin"}
+	default:
+		args = []string{"fetch", "--no-tags", "origin", ref}
+	}
+	cmd := exec.Command("git", gitArgs(args...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run() == nil
+}
+
+/*
+  Returns the revisions on the old and new side of a commitComparison, as
+  described by gitAllDiffs. An empty new revision means the working tree:
+
+    "" or "<commit>"        -> <commit> (or HEAD), working tree
+    "<a> <b>", "<a>..<b>"   -> <a>, <b>
+    "<a>...<b>"             -> merge-base of <a> and <b>, <b>
+
+  Omitted sides of ".." and "..." default to HEAD.
+*/
+func gitRevisions(commitComparison string) (string, string) {
+	commitComparison = strings.TrimSpace(commitComparison)
+	orHEAD := func(rev string) string {
+		if rev = strings.TrimSpace(rev); rev == "" {
+			return "HEAD"
+		}
+		return rev
+	}
+	switch {
+	case strings.Contains(commitComparison, "..."):
+		sides := strings.SplitN(commitComparison, "...", 2)
+		oldRev, newRev := orHEAD(sides[0]), orHEAD(sides[1])
+		return strings.TrimSpace(string(shell("git", gitArgs("merge-base", oldRev, newRev)...))), newRev
+	case strings.Contains(commitComparison, ".."):
+		sides := strings.SplitN(commitComparison, "..", 2)
+		return orHEAD(sides[0]), orHEAD(sides[1])
+	case strings.Contains(commitComparison, " "):
+		sides := strings.Fields(commitComparison)
+		return sides[0], sides[1]
+	default:
+		return orHEAD(commitComparison), ""
+	}
+}
+
+/*
+  Returns the commit comparison "<tag>..HEAD" for the most recent tag reachable
+  from HEAD. Without any tags it warns on stderr and compares against the root
+  commit instead.
+*/
+func gitSinceLastTag() string {
+	output, err := exec.Command("git", gitArgs("describe", "--tags", "--abbrev=0")...).Output()
+	if tag := strings.TrimSpace(string(output)); err == nil && tag != "" {
+		return tag + "..HEAD"
+	}
+	roots := strings.Fields(string(shell("git", gitArgs("rev-list", "--max-parents=0", "HEAD")...)))
+	if len(roots) == 0 {
+		failf("-since-last-tag: no tags and no commits to compare against")
+	}
+	fmt.Fprintf(os.Stderr, "warning: -since-last-tag found no tags, comparing against the root commit %s\n", roots[0])
+	return roots[0] + "..HEAD"
+}
+
+/*
+  Reads the contents of files at rev with a single git cat-file --batch,
+  rather than a git show per file. Files that don't exist at rev (or aren't
+  files there, eg: a submodule) are left out.
+*/
+func gitBlobs(rev string, files []string) (map[string][]byte, error) {
+	var input bytes.Buffer
+	var requested []string
+	for _, file := range files {
+		if strings.ContainsAny(file, "\n\r") {
+			continue // cat-file reads one object name per line
+		}
+		fmt.Fprintf(&input, "%s:%s\n", rev, filepath.ToSlash(file))
+		requested = append(requested, file)
+	}
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	cmd := exec.Command("git", gitArgs("cat-file", "--batch")...)
+	cmd.Stdin = &input
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errGitFailed, strings.Join(cmd.Args, " "), err)
+	}
+
+	// Each object is "<oid> <type> <size>\n<contents>\n", or "<name> missing\n" (or ambiguous)
+	blobs := map[string][]byte{}
+	for _, file := range requested {
+		end := bytes.IndexByte(output, '\n')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: git cat-file: truncated output at %s", errGitFailed, file)
+		}
+		line := string(output[:end])
+		output = output[end+1:]
+		// The name is echoed back as is, so it may contain spaces (eg: "HEAD:a/new file.go missing")
+		if strings.HasSuffix(line, " missing") || strings.HasSuffix(line, " ambiguous") {
+			continue
+		}
+		header := strings.Fields(line)
+		if len(header) != 3 {
+			return nil, fmt.Errorf("%w: git cat-file: bad object header %q", errGitFailed, line)
+		}
+		size, err := strconv.Atoi(header[2])
+		if err != nil || size+1 > len(output) {
+			return nil, fmt.Errorf("%w: git cat-file: bad object header %q", errGitFailed, strings.Join(header, " "))
+		}
+		if header[1] == "blob" {
+			blobs[file] = output[:size]
+		}
+		output = output[size+1:]
+	}
+	return blobs, nil
+}
+
+// git diff --name-only [--diff-filter=<diffFilter>] <commitPattern> [-- <pathspecs>...]
+func gitDiff(commitPattern, diffFilter string, pathspecs []string) StringSet {
+	args := []string{"diff", "--name-only"}
+	if diffFilter != "" {
+		args = append(args, "--diff-filter="+diffFilter)
+	}
+	// "<commit> <commit>" must be passed to git as two arguments
+	output := shell("git", gitArgs(withPathspecs(append(args, strings.Fields(commitPattern)...), pathspecs)...)...)
 
 	filenames := StringSet{}
 	for _, file := range bytes.Split(output, []byte{'\n'}) {
@@ -96,6 +404,193 @@ func gitDiff(commitPattern string) StringSet {
 	return filenames
 }
 
+/*
+  Finds the files whose only changes in commitPattern are to whitespace.
+  git diff --name-only lists a file regardless of -w, so instead the files
+  git diff --numstat reports with and without -w are compared: -w leaves out
+  files with nothing but whitespace changes.
+*/
+func gitWhitespaceOnly(commitPattern string, pathspecs []string) StringSet {
+	commitPattern = effectiveComparison(commitPattern)
+	numstat := func(flags ...string) StringSet {
+		args := append(append([]string{"diff", "--numstat", "--no-renames", "-z"}, flags...), strings.Fields(commitPattern)...)
+		files := StringSet{}
+		for _, line := range bytes.Split(shell("git", gitArgs(withPathspecs(args, pathspecs)...)...), []byte{0}) {
+			// eg: 1	0	foo/bar.go
+			if fields := strings.SplitN(string(line), "\t", 3); len(fields) == 3 {
+				files.Add(fields[2])
+			}
+		}
+		return files
+	}
+	whitespaceOnly := numstat()
+	for file := range numstat("--ignore-all-space") {
+		whitespaceOnly.Del(file)
+	}
+	return whitespaceOnly
+}
+
+/*
+  Determines which files changed inside each initialized submodule, relative to
+  the superproject's root, for the same commitComparison as gitAllDiffs. The
+  submodule's commit on the old side is read from the superproject's gitlink,
+  so moving a submodule forward reports every file changed in between. Returns
+  the changed files along with the submodule paths, which git reports as
+  changed "files" of the superproject. A submodule that git fails on is a
+  problem (see -keep-going) rather than the end of the run.
+*/
+func gitSubmoduleDiffs(commitComparison, projectDir string) (StringSet, StringSet) {
+	oldRev, newRev := gitRevisions(commitComparison)
+	diffs, submodules := StringSet{}, StringSet{}
+
+	output := shell("git", gitArgs("-C", projectDir, "ls-files", "--stage", "-z")...)
+	for _, path := range parseGitlinks(output) {
+		if _, err := os.Stat(filepath.Join(projectDir, path, ".git")); err != nil {
+			continue // not initialized
+		}
+		submodules.Add(path)
+		files, err := submoduleDiffs(projectDir, path, oldRev, newRev)
+		if err != nil {
+			problem(fmt.Errorf("submodule %s: %w", path, err))
+			continue
+		}
+		diffs.Merge(files)
+	}
+	return diffs, submodules
+}
+
+/*
+  Returns the paths of the submodules (gitlinks, mode 160000) in the output of
+  git ls-files --stage -z, whose entries are eg:
+  "160000 ea630db6d78b7cca1499135527391c607ab81d06 0\tvendor/foo\x00". Paths
+  may contain spaces, so they're taken whole from after the tab.
+*/
+func parseGitlinks(output []byte) []string {
+	paths := StringSet{}
+	for _, entry := range strings.Split(string(output), "\x00") {
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 || !strings.HasPrefix(entry, "160000 ") {
+			continue
+		}
+		paths.Add(entry[tab+1:]) // once, even with several merge stages
+	}
+	return paths.SortedSlice()
+}
+
+// Lists the files changed inside the submodule at path between the superproject's oldRev and newRev, relative to the superproject's root.
+func submoduleDiffs(projectDir, path, oldRev, newRev string) (StringSet, error) {
+	subDir := filepath.Join(projectDir, path)
+	var listings [][]string
+	oldCommit, ok := gitlink(projectDir, oldRev, path)
+	switch {
+	case !ok:
+		// The submodule is new, so everything in it changed
+		listings = append(listings, []string{"-C", subDir, "ls-files", "-z"})
+	case newRev != "":
+		newCommit, ok := gitlink(projectDir, newRev, path)
+		if !ok || newCommit == oldCommit {
+			return StringSet{}, nil
+		}
+		listings = append(listings, []string{"-C", subDir, "diff", "--name-only", "-z", oldCommit, newCommit})
+	default:
+		listings = append(listings,
+			[]string{"-C", subDir, "diff", "--name-only", "-z", oldCommit},
+			[]string{"-C", subDir, "ls-files", "-z", "--others", "--exclude-standard"})
+	}
+
+	diffs := StringSet{}
+	for _, args := range listings {
+		output, err := tryShell("git", args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range strings.Split(string(output), "\x00") {
+			if file != "" {
+				diffs.Add(path + "/" + file)
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// Returns the commit recorded for the submodule at path in the superproject's rev.
+func gitlink(projectDir, rev, path string) (string, bool) {
+	output, err := exec.Command("git", gitArgs("-C", projectDir, "rev-parse", "--verify", "--quiet", rev+":"+path)...).Output()
+	return strings.TrimSpace(string(output)), err == nil
+}
+
+// A file that git detected as moved from one path to another, relative to the project root.
+type rename struct {
+	from, to string
+}
+
+// git diff --name-status -M --diff-filter=R <commitPattern> [-- <pathspecs>...]
+func gitRenames(commitPattern string, pathspecs []string) []rename {
+	commitPattern = effectiveComparison(commitPattern)
+	args := append([]string{"diff", "--name-status", "-M", "--diff-filter=R"}, strings.Fields(commitPattern)...)
+	output := shell("git", gitArgs(withPathspecs(args, pathspecs)...)...)
+
+	var renames []rename
+	for _, line := range bytes.Split(output, []byte{'\n'}) {
+		// eg: R100	foo/bar.go	baz/bar.go
+		fields := strings.Split(string(line), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		renames = append(renames, rename{from: fields[1], to: fields[2]})
+	}
+	return renames
+}
+
+func withPathspecs(args, pathspecs []string) []string {
+	if len(pathspecs) == 0 {
+		return args
+	}
+	return append(append(args, "--"), pathspecs...)
+}
+
+// The status letters accepted by git diff --diff-filter.
+const diffFilterStatuses = "ACDMRTUXB"
+
+// Returns an error if filter contains anything other than git's diff status letters (or "*").
+func validateDiffFilter(filter string) error {
+	for _, r := range filter {
+		if r != '*' && !strings.ContainsRune(diffFilterStatuses, unicode.ToUpper(r)) {
+			return fmt.Errorf("invalid -diff-filter %q: %q is not one of %s (or their lowercase forms to exclude)", filter, r, diffFilterStatuses)
+		}
+	}
+	return nil
+}
+
+/*
+  Reports whether files with the given status survive the filter, following
+  git's semantics: uppercase letters select statuses, lowercase letters exclude
+  them, and an empty filter selects everything.
+*/
+func diffFilterIncludes(filter string, status rune) bool {
+	if strings.ContainsRune(filter, unicode.ToLower(status)) {
+		return false
+	}
+	if strings.ContainsRune(filter, '*') || strings.ToLower(filter) == filter {
+		// Nothing explicitly selected, so everything not excluded is included
+		return true
+	}
+	return strings.ContainsRune(filter, status)
+}
+
+/*
+  Prefixes the arguments of a git command for the superproject with -git-dir
+  and -work-tree, when set, so repositories whose .git isn't inside the work
+  tree (eg: a bare repository with a separate checkout) can be analyzed.
+  Submodule commands run against their own repositories and don't use this.
+*/
+func gitArgs(args ...string) []string {
+	if *gitDir == "" {
+		return args
+	}
+	return append([]string{"--git-dir=" + *gitDir, "--work-tree=" + *workTree}, args...)
+}
+
 func gitRoot() string {
-	return strings.TrimSpace(string(shell("git", "rev-parse", "--show-toplevel")))
+	return strings.TrimSpace(string(shell("git", gitArgs("rev-parse", "--show-toplevel")...)))
 }
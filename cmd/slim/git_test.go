@@ -0,0 +1,216 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePorcelain(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []statusEntry
+	}{
+		{
+			name:   "modified and untracked",
+			output: " M circle.yml\x00?? thjson/bar/baz/biz.txt\x00",
+			want:   []statusEntry{{" M", "circle.yml"}, {"??", "thjson/bar/baz/biz.txt"}},
+		},
+		{
+			name:   "renamed",
+			output: "R  new.go\x00old.go\x00?? a.txt\x00",
+			want:   []statusEntry{{"R ", "new.go"}, {"??", "a.txt"}},
+		},
+		{
+			name:   "copied",
+			output: "C  copy.go\x00orig.go\x00 M b.go\x00",
+			want:   []statusEntry{{"C ", "copy.go"}, {" M", "b.go"}},
+		},
+		{
+			name:   "spaces and arrows",
+			output: "?? with space.go\x00R  a -> b.go\x00c.go\x00",
+			want:   []statusEntry{{"??", "with space.go"}, {"R ", "a -> b.go"}},
+		},
+		{
+			name:   "empty",
+			output: "",
+			want:   nil,
+		},
+	}
+	for _, test := range tests {
+		if got := parsePorcelain([]byte(test.output)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parsePorcelain(%q) = %q, want %q", test.name, test.output, got, test.want)
+		}
+	}
+}
+
+func TestParsePorcelainV2(t *testing.T) {
+	const modes = "N... 100644 100644 100644 1111111111111111111111111111111111111111 2222222222222222222222222222222222222222"
+	tests := []struct {
+		name   string
+		output string
+		want   []statusEntry
+	}{
+		{
+			name:   "changed and untracked",
+			output: "1 .M " + modes + " circle.yml\x00? thjson/bar/baz/biz.txt\x00",
+			want:   []statusEntry{{" M", "circle.yml"}, {"??", "thjson/bar/baz/biz.txt"}},
+		},
+		{
+			name:   "renamed",
+			output: "2 R. " + modes + " R100 new.go\x00old.go\x00? a.txt\x00",
+			want:   []statusEntry{{"R ", "new.go"}, {"??", "a.txt"}},
+		},
+		{
+			name:   "copied",
+			output: "2 C. " + modes + " C75 copy.go\x00orig.go\x001 M. " + modes + " b.go\x00",
+			want:   []statusEntry{{"C ", "copy.go"}, {"M ", "b.go"}},
+		},
+		{
+			name:   "spaces",
+			output: "? with space.go\x002 R. " + modes + " R100 new name.go\x00old name.go\x00",
+			want:   []statusEntry{{"??", "with space.go"}, {"R ", "new name.go"}},
+		},
+		{
+			name:   "unmerged and ignored",
+			output: "u UU N... 100644 100644 100644 100644 1111111 2222222 3333333 both.go\x00! build/out.bin\x00",
+			want:   []statusEntry{{"UU", "both.go"}, {"!!", "build/out.bin"}},
+		},
+		{
+			name:   "headers",
+			output: "# branch.oid abc123\x00# branch.head main\x00? a.txt\x00",
+			want:   []statusEntry{{"??", "a.txt"}},
+		},
+	}
+	for _, test := range tests {
+		if got := parsePorcelainV2([]byte(test.output)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parsePorcelainV2(%q) = %q, want %q", test.name, test.output, got, test.want)
+		}
+	}
+}
+
+func TestGitWhitespaceOnly(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"a/a.go": "package a\n\nfunc A() int {\n\treturn 1\n}\n",
+		"b/b.go": "package b\n\nfunc B() int {\n\treturn 1\n}\n",
+		"c/c.go": "package c\n\nfunc C() int {\n\treturn 1\n}\n",
+	})
+	writeFiles(t, projectDir, map[string]string{
+		"a/a.go": "package a\n\nfunc A()   int {\n    return 1\n}\n", // reindented
+		"b/b.go": "package b\n\nfunc B() int {\n\treturn 2\n}\n",     // a real change
+		"c/c.go": "package c\n\nfunc C() int {\n\n\treturn 1\n}\n",   // an added blank line
+	})
+
+	want := StringSet{}
+	want.Add("a/a.go")
+	if got := gitWhitespaceOnly("HEAD", nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("working tree: gitWhitespaceOnly = %v, want %v", got, want)
+	}
+
+	run(t, projectDir, "git", "commit", "-q", "-am", "edits")
+	if got := gitWhitespaceOnly("HEAD~1 HEAD", nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed: gitWhitespaceOnly = %v, want %v", got, want)
+	}
+	if got := gitWhitespaceOnly("HEAD~1 HEAD", []string{"b"}); len(got) != 0 {
+		t.Errorf("with pathspec b: gitWhitespaceOnly = %v, want none", got)
+	}
+}
+
+func TestGitBlobs(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":          "package a\n",
+		"b/with space.go": "package b\n\n// a line\n\n",
+		"c/empty.go":      "",
+	}
+	gitFixture(t, files)
+
+	got, err := gitBlobs("HEAD", []string{"a/a.go", "b/with space.go", "c/empty.go", "d/missing.go", "d/new file.go", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{}
+	for name, content := range files {
+		want[name] = []byte(content)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gitBlobs = %q, want %q", got, want)
+	}
+}
+
+// Constraint changes are found from the blobs of both revisions.
+func TestConstraintChangesBetweenRevisions(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"a/a.go": "package a\n",
+		"b/b.go": "//go:build linux\n\npackage b\n",
+		"c/c.go": "//go:build linux\n\npackage c\n",
+	})
+	writeFiles(t, projectDir, map[string]string{
+		"a/a.go": "//go:build ignore\n\npackage a\n",
+		"b/b.go": "//go:build linux\n\npackage b\n\nvar B int\n",
+		"c/c.go": "//go:build darwin\n\npackage c\n",
+		"d/d.go": "//go:build windows\n\npackage d\n",
+	})
+	run(t, projectDir, "git", "add", "-A")
+	run(t, projectDir, "git", "commit", "-q", "-m", "constraints")
+
+	diffs := gitAllDiffs("HEAD~1 HEAD", "", nil)
+	readOld, readNew := revisionReader("HEAD~1", diffs, projectDir), revisionReader("HEAD", diffs, projectDir)
+	got := constraintChanges(diffs, readOld, readNew, projectDir)
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(got.SortedSlice(), want) {
+		t.Errorf("constraintChanges = %q, want %q", got.SortedSlice(), want)
+	}
+}
+
+func TestParseGitlinks(t *testing.T) {
+	const sha = "ea630db6d78b7cca1499135527391c607ab81d06"
+	output := "100644 " + sha + " 0\ta/a.go\x00" +
+		"160000 " + sha + " 0\text/lib\x00" +
+		"160000 " + sha + " 0\tvendor dir/sub\x00" +
+		"160000 " + sha + " 1\tconflicted\x00160000 " + sha + " 2\tconflicted\x00"
+	if got, want := parseGitlinks([]byte(output)), []string{"conflicted", "ext/lib", "vendor dir/sub"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGitlinks = %q, want %q", got, want)
+	}
+}
+
+// Files changed inside submodules impact the packages of the superproject that import them.
+func TestSubmoduleDiffs(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	projectDir := gitFixture(t, map[string]string{
+		"a/a.go": "package a\n\nimport _ \"example.com/fx/ext/lib\"\n",
+		"b/b.go": "package b\n",
+	})
+	repos := map[string]map[string]string{
+		"ext/lib":           {"lib.go": "package lib\n"},
+		"vendor dir/assets": {"README.txt": "assets\n"},
+	}
+	for _, path := range []string{"ext/lib", "vendor dir/assets"} {
+		repo := filepath.Join(t.TempDir(), "repo")
+		writeFiles(t, repo, repos[path])
+		run(t, repo, "git", "init", "-q")
+		run(t, repo, "git", "add", "-A")
+		run(t, repo, "git", "commit", "-q", "-m", path)
+		run(t, projectDir, "git", "-c", "protocol.file.allow=always", "submodule", "add", "-q", repo, path)
+	}
+	run(t, projectDir, "git", "commit", "-q", "-m", "submodules")
+
+	// A commit inside one submodule, and an untracked file inside the other, whose path has a space
+	writeFiles(t, projectDir, map[string]string{
+		"ext/lib/lib.go":            "package lib\n\nvar Lib int\n",
+		"vendor dir/assets/new.txt": "new\n",
+	})
+	run(t, filepath.Join(projectDir, "ext", "lib"), "git", "commit", "-q", "-am", "change")
+
+	diffs, submodules := gitSubmoduleDiffs("HEAD", projectDir)
+	if got, want := diffs.SortedSlice(), []string{"ext/lib/lib.go", "vendor dir/assets/new.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("submodule diffs = %q, want %q", got, want)
+	}
+	if got, want := submodules.SortedSlice(), []string{"ext/lib", "vendor dir/assets"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("submodules = %q, want %q", got, want)
+	}
+
+	want := []string{"a", filepath.Join("ext", "lib")}
+	if got := impactedPaths(t, "golist", diffs, projectDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("impacted %q, want %q", got, want)
+	}
+}
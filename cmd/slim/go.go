@@ -3,20 +3,60 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
 	"io"
 )
 
+// Wraps the failures of go list, see shell.
+var errGoListFailed = errors.New("go list failed")
+
 type Package struct {
 	Dir          string
 	Root         string
 	ImportPath   string
+	Module       *Module
+	DepOnly      bool
+	Imports      []string
+	SFiles       []string
+	SysoFiles    []string
+	TestGoFiles  []string
+	XTestGoFiles []string
 	Deps         []string
 	TestImports  []string
 	XTestImports []string
+	Error        *PackageError
+	DepsErrors   []*PackageError
+}
+
+// The module containing a package, as reported by `go list -json`. Nil outside of module mode.
+type Module struct {
+	Path string
+	Dir  string
+}
+
+// Mirrors the error structure reported by `go list -e -json`.
+type PackageError struct {
+	ImportStack []string
+	Pos         string
+	Err         string
 }
 
+func (err *PackageError) Error() string {
+	if err.Pos != "" {
+		return err.Pos + ": " + err.Err
+	}
+	return err.Err
+}
+
+/*
+  Runs `go list -e -json` so that packages which fail to load (syntax errors,
+  missing imports, ...) are still reported, with the problem recorded in their
+  Error and DepsErrors fields rather than aborting the run.
+*/
 func goList(args []string) []Package {
-	output := shell("go", append([]string{"list", "-json"}, args...)...)
+	output := shell("go", append([]string{"list", "-e", "-json"}, args...)...)
 	buf := bytes.NewBuffer(output)
 	dec := json.NewDecoder(buf)
 	var packages []Package
@@ -32,3 +72,114 @@ func goList(args []string) []Package {
 	}
 	return packages
 }
+
+// Maps an import path to the absolute directory of the package it names.
+type dirResolver func(importPath string) (string, error)
+
+/*
+  Resolves import paths using the output of `go list -deps`, which is module
+  and vendor aware. Test imports are not part of -deps, so any that are missing
+  are looked up with a single follow-up `go list -find`.
+*/
+func goListResolver(packages []Package) dirResolver {
+	dirs := map[string]string{}
+	for _, pkg := range packages {
+		dirs[pkg.ImportPath] = pkg.Dir
+	}
+
+	missing := StringSet{}
+	for _, pkg := range packages {
+		for _, imports := range [][]string{pkg.TestImports, pkg.XTestImports} {
+			for _, dep := range imports {
+				if _, ok := dirs[dep]; !ok {
+					missing.Add(dep)
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		for _, pkg := range goList(append([]string{"-find"}, missing.SortedSlice()...)) {
+			dirs[pkg.ImportPath] = pkg.Dir
+		}
+	}
+
+	return func(importPath string) (string, error) {
+		dir := dirs[importPath]
+		if dir == "" {
+			return "", fmt.Errorf("cannot find package %q", importPath)
+		}
+		return dir, nil
+	}
+}
+
+/*
+  Resolves import paths with go/build relative to srcDir. This avoids the extra
+  `go list` work but only understands GOPATH and vendor directories.
+*/
+func goBuildResolver(srcDir string) dirResolver {
+	return func(importPath string) (string, error) {
+		buildPkg, err := build.Import(importPath, srcDir, build.FindOnly)
+		if err != nil {
+			return "", err
+		}
+		return buildPkg.Dir, nil
+	}
+}
+
+/*
+  Returns the first error go list reported for a pattern itself (eg: a
+  directory that doesn't exist, or one outside the main module), or nil.
+  With -e such errors come back as a package with an Error but no Dir, and
+  analyzing without them would silently skip every package they should have
+  matched. Errors loading a package that was found are left to the analysis.
+*/
+func patternError(packages []Package) error {
+	for _, pkg := range packages {
+		if !pkg.DepOnly && pkg.Error != nil && pkg.Dir == "" {
+			return pkg.Error
+		}
+	}
+	return nil
+}
+
+/*
+  Lists the packages matching patterns, along with an index of every package
+  go list reported (dependencies included) and the dirResolver named by
+  -resolver ("golist" or "gobuild") for their imports. The gobuild resolver
+  skips listing dependencies, so its index only holds the matched packages.
+*/
+func loadPackages(resolver string, patterns []string, projectDir string) ([]Package, packageIndex, dirResolver) {
+	if resolver == "gobuild" {
+		packages := goList(patterns)
+		return packages, indexPackages(packages), goBuildResolver(projectDir)
+	}
+	packages := goList(append([]string{"-deps"}, patterns...))
+	return withoutDepOnly(packages), indexPackages(packages), goListResolver(packages)
+}
+
+/*
+  Maps import paths to packages. Import chains between the matched packages
+  can pass through packages that weren't matched (eg: a -> b -> c listed with
+  ./a/... ./c/...), so chains are followed through the index of every listed
+  package, not just the matched ones.
+*/
+type packageIndex map[string]Package
+
+func indexPackages(packages []Package) packageIndex {
+	index := packageIndex{}
+	for _, pkg := range packages {
+		index[pkg.ImportPath] = pkg
+	}
+	return index
+}
+
+// Returns the packages that matched the go list patterns, dropping those only listed as dependencies.
+func withoutDepOnly(packages []Package) []Package {
+	var matched []Package
+	for _, pkg := range packages {
+		if !pkg.DepOnly {
+			matched = append(matched, pkg)
+		}
+	}
+	return matched
+}
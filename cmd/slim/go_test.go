@@ -0,0 +1,52 @@
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+  Both resolvers should find the same dependents in a GOPATH layout, which is
+  the only one -resolver=gobuild understands.
+*/
+func TestResolversAgreeInGOPATH(t *testing.T) {
+	requireTools(t, "go")
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	gopath := canonicalPath(t.TempDir())
+	t.Setenv("GOPATH", gopath)
+	t.Setenv("GO111MODULE", "off")
+	t.Setenv("GOFLAGS", "")
+	oldGOPATH := build.Default.GOPATH
+	build.Default.GOPATH = gopath
+	t.Cleanup(func() {
+		build.Default.GOPATH = oldGOPATH
+	})
+
+	projectDir := filepath.Join(gopath, "src", "example.com", "fx")
+	writeFiles(t, projectDir, abcFiles)
+	writeFiles(t, projectDir, map[string]string{
+		"vendor/example.com/v/v.go": "package v\n",
+		"d/d.go":                    "package d\n\nimport _ \"example.com/v\"\n",
+	})
+	chdir(t, projectDir)
+
+	for _, diff := range []string{"a/a.go", "b/b.go", "c/c_test.go", "vendor/example.com/v/v.go"} {
+		diffs := StringSet{}
+		diffs.Add(diff)
+		golist := impactedPaths(t, "golist", diffs, projectDir)
+		gobuild := impactedPaths(t, "gobuild", diffs, projectDir)
+		if !reflect.DeepEqual(golist, gobuild) {
+			t.Errorf("changing %s: golist resolver impacted %q, gobuild resolver impacted %q", diff, golist, gobuild)
+		}
+	}
+
+	// And the sets are the expected ones, so agreeing on nothing doesn't pass
+	diffs := StringSet{}
+	diffs.Add("a/a.go")
+	want := []string{"a", "b", "c"}
+	if got := impactedPaths(t, "gobuild", diffs, projectDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("changing a/a.go impacted %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Kinds of Event.
+const (
+	eventPhase      = "phase"      // a phase of the run finished
+	eventClassified = "classified" // a changed file was classified by the diff rules
+	eventImpacted   = "impacted"   // a path was marked impacted, or its reason changed
+	eventUnresolved = "unresolved" // a dependency couldn't be resolved to a directory and was skipped
+	eventConstraint = "constraint" // the build constraints of a changed file changed
+	eventPruned     = "pruned"     // an impacted path was dropped for a reason other than having no go files
+)
+
+// A decision made during the run, reported to every registered Logger.
+type Event struct {
+	Kind    string        `json:"kind"`
+	Phase   string        `json:"phase,omitempty"`
+	Path    string        `json:"path,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Trigger string        `json:"trigger,omitempty"`
+	Took    time.Duration `json:"took,omitempty"`
+}
+
+// Receives events as the analysis makes decisions.
+type Logger interface {
+	Log(Event)
+}
+
+// Adapts a plain function to the Logger interface.
+type LoggerFunc func(Event)
+
+func (fn LoggerFunc) Log(e Event) {
+	fn(e)
+}
+
+// The loggers events are sent to, as configured by -debug and -log-json.
+var loggers []Logger
+
+func logEvent(e Event) {
+	for _, logger := range loggers {
+		logger.Log(e)
+	}
+}
+
+// Prints classification and impact decisions as plain text. Phases are left to the -debug timings section.
+func textLogger(e Event) {
+	switch e.Kind {
+	case eventClassified:
+		fmt.Printf("classified %s as %s\n", e.Path, e.Reason)
+	case eventImpacted:
+		fmt.Printf("impacted %s (%s: %s)\n", e.Path, e.Reason, e.Trigger)
+	case eventUnresolved:
+		fmt.Printf("skipping unresolved dependency %s of %s: %s\n", e.Trigger, e.Path, e.Reason)
+	case eventConstraint:
+		fmt.Printf("build constraints of %s changed: %s\n", e.Path, e.Reason)
+	case eventPruned:
+		fmt.Printf("pruned %s: %s\n", e.Path, e.Reason)
+	}
+}
+
+// Writes each event as a line of JSON to stderr.
+func jsonLogger(e Event) {
+	b, err := json.Marshal(e)
+	check(err)
+	fmt.Fprintln(os.Stderr, string(b))
+}
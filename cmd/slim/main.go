@@ -1,39 +1,297 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/build"
-	"io/ioutil"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"runtime/pprof"
 	"sort"
 	"strings"
+	"time"
 )
 
+/*
+  The version of slim, for builds that inject one with
+  -ldflags="-X main.Version=v1.2.3". Otherwise the module version recorded in
+  the build info is used (see versionString).
+*/
+var Version = ""
+
 var (
-	diff  = flag.String("diff", "HEAD", "The git commit pattern to diff by. E.g.: 'HEAD', or '<commit>...<commit>'")
-	debug = flag.Bool("debug", false, "Verbose output.")
+	sourceExts   stringsFlag
+	testdataDirs stringsFlag
+	pathspecs    stringsFlag
+	always       stringsFlag
 )
 
-const (
-	sep              = string(filepath.Separator)
-	testdataPattern1 = "testdata" + sep
-	testdataPattern2 = sep + "testdata" + sep
+func init() {
+	flag.Var(&sourceExts, "source-ext", "An additional file extension (eg: '.sql') whose changes alter the package in the same directory. May be repeated.")
+	flag.Var(&pathspecs, "pathspec", "A git pathspec (eg: 'services/') limiting which changed files are considered. May be repeated.")
+	flag.Var(&always, "always", "A glob (eg: 'smoke/*') of package dirs, relative to the project root, to always list regardless of the diff. May be repeated.")
+	flag.Var(&testdataDirs, "testdata-dir", "A directory name whose contents are test fixtures, like 'testdata' (the default). May be repeated.")
+}
+
+var (
+	depth                 = flag.Int("depth", -1, "Only list dependents at most this many imports away from an altered package (0 lists changed packages only). Unlimited when negative")
+	diff                  = flag.String("diff", "HEAD", "The git commit pattern to diff by. E.g.: 'HEAD', or '<commit>...<commit>'")
+	diffFilter            = flag.String("diff-filter", "", "Only consider files with these git statuses, passed through to 'git diff --diff-filter'. E.g.: 'AM', or 'd'")
+	allPackages           = flag.Bool("all-packages", false, "List every package in <packages> instead of diffing, for full runs that still use slim's pruning and formats")
+	ascendToPackage       = flag.Bool("ascend-to-package", false, "Replace impacted directories that aren't packages with their nearest ancestor package instead of dropping them")
+	cover                 = flag.Bool("cover", false, "With -format=gotest, measure coverage of the impacted packages only (via -coverpkg)")
+	coverProfile          = flag.String("coverprofile", "", "With -cover, have each go test command write its coverage profile to this file, named apart per -shard and tag set so the profiles can be merged")
+	baseDir               = flag.String("base-dir", "", "Compare the current directory against this copy of the base tree instead of using git (eg: a restored CI snapshot)")
+	baselineFile          = flag.String("baseline-file", "", "Compare the impacted paths with this newline separated list (eg: written earlier with -out) and print the added and removed paths to stderr")
+	baselineCheck         = flag.Bool("baseline-check", false, "With -baseline-file, exit non-zero when the impacted paths differ from the baseline")
+	benchmarksOnly        = flag.Bool("benchmarks-only", false, "Only list impacted packages whose tests declare Benchmark functions. With -format=gotest, print a command that runs just the benchmarks")
+	ignoreCommentChanges  = flag.Bool("ignore-comment-changes", false, "Ignore changes to go files that only touch comments or whitespace, comparing the old and new tokens of each file (slower)")
+	classify              = flag.String("classify", "", "Print how a single file would be classified, and the directory it belongs to, then exit without diffing (eg: for editor integrations)")
+	commitRangeValidation = flag.Bool("commit-range-validation", true, "Check that every ref in -diff exists before diffing")
+	changedWithin         = flag.String("changed-within", "", "Scope the run to one subtree (relative to the project root): only its changed files count, only its packages are listed by go list and only its impacted packages are output")
+	debug                 = flag.Bool("debug", false, "Verbose output.")
+	envVar                = flag.String("env-var", "SLIM_PACKAGES", "The variable name assigned by -format=env")
+	excludeNoTestDeps     = flag.Bool("exclude-no-test-deps", false, "Leave out impacted packages without tests that no impacted package with tests needs to build its tests")
+	failOnUnresolved      = flag.Bool("fail-on-unresolved", false, "Exit with an error listing any imports that couldn't be resolved to a directory, instead of skipping them")
+	fetchBase             = flag.Bool("fetch-base", false, "Fetch refs in -diff that are missing locally (eg: in a shallow CI checkout) instead of failing")
+	filesOmitEmpty        = flag.Bool("files-omit-empty", false, "With -format=files, leave out impacted paths without changed files of their own (eg: dependents)")
+	format                = flag.String("format", "text", "Output format, one of: "+strings.Join(formatNames(), ", "))
+	gitDir                = flag.String("git-dir", "", "Path to the repository's git directory, for when it isn't inside the work tree (requires -work-tree)")
+	includeDepsInOutput   = flag.Bool("include-deps-in-output", false, "Also print the altered dependencies that impacted each dependent package (text, json and jsonl formats)")
+	keepGoing             = flag.Bool("keep-going", false, "Carry on past non-fatal errors (eg: a broken submodule, or unresolved imports with -fail-on-unresolved) and report them all at the end, like make -k")
+	ignoreWhitespace      = flag.Bool("ignore-whitespace", false, "Ignore files whose only changes are to whitespace (like 'git diff -w')")
+	importPathStyle       = flag.String("importpath-style", "full", "How -format=importpath prints packages: 'full' import paths or 'module-relative' paths")
+	jsonCompact           = flag.Bool("json-compact", false, "Print the json, by-module and files formats on a single line instead of indented")
+	logJSON               = flag.Bool("log-json", false, "Write each analysis decision to stderr as a line of JSON")
+	movedPackages         = flag.Bool("moved-packages", false, "When go files move to another directory, also treat importers of the old import path as impacted")
+	noPrune               = flag.Bool("no-prune", false, "Keep impacted directories that have no buildable go files (eg: asset-only directories)")
+	onlyDirsWithChanges   = flag.Bool("only-dirs-with-changes", false, "Only list directories with changed files or testdata, skipping go list and the search for dependents")
+	out                   = flag.String("out", "", "Also write the output to this file, creating parent directories and truncating it first")
+	outOnly               = flag.Bool("out-only", false, "With -out, write the output only to the file and not to stdout")
+	paths                 = flag.String("paths", "", "Comma or newline separated list of files (relative to the project root) to analyze instead of the whole diff")
+	pathsMode             = flag.String("paths-mode", "intersect", "How -paths combines with the git diff: 'intersect' or 'replace'")
+	pathBase              = flag.String("path-base", "root", "What printed paths are relative to: 'root' (the project root) or 'cwd' (the working directory), or 'absolute' for absolute paths")
+	printCommit           = flag.Bool("print-commit", false, "Print the commit comparison that would be diffed (after defaults and -since-last-tag) and exit")
+	printRoot             = flag.Bool("print-root", false, "Print the project root that paths are relative to and exit")
+	profile               = flag.String("profile", "", "Write a CPU profile of the run to this file")
+	shard                 = flag.Int("shard", 0, "Which shard to print, from 0 to -shards minus 1")
+	shards                = flag.Int("shards", 1, "Split the impacted packages into this many balanced shards (see -shard)")
+	sinceLastTag          = flag.Bool("since-last-tag", false, "Compare the most recent tag with HEAD (<tag>..HEAD) instead of using -diff")
+	skipBroken            = flag.Bool("skip-broken", false, "Leave out impacted packages that currently fail to build, listing them on stderr instead")
+	splitTestTags         = flag.Bool("split-test-tags", false, "With -format=gotest, print a command per set of test build tags, so tag-partitioned tests only run when their own files change")
+	outputTrailingNewline = flag.Bool("output-trailing-newline", true, "End the output with a newline (or NUL for -format=null-json) after the last entry")
+	vetFlags              = flag.String("vet-flags", "", "With -format=govet, space separated flags to pass to go vet, eg: analyzer flags")
+	submodules            = flag.Bool("submodules", false, "Also consider files changed inside git submodules")
+	printVersion          = flag.Bool("version", false, "Print the version of slim and the Go version it was built with, then exit")
+	verboseTiming         = flag.Bool("verbose-timing", false, "Write how long each phase of the run took to stderr")
+	workTree              = flag.String("work-tree", "", "Path to the work tree checked out from -git-dir (requires -git-dir)")
+	withTestsOnly         = flag.Bool("with-tests-only", false, "Only list impacted packages that have tests which build on this platform")
+	resolver              = flag.String("resolver", "golist", "How to resolve import paths to directories: 'golist' (module aware) or 'gobuild' (GOPATH only, faster)")
 )
 
+const sep = string(filepath.Separator)
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\t%s [-debug] [-diff <diff>] [<packages>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\t%s [flags] [<packages>]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	diffs := gitAllDiffs(*diff)
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *resolver != "golist" && *resolver != "gobuild" {
+		failf(fmt.Sprintf("invalid -resolver %q: must be 'golist' or 'gobuild'", *resolver))
+	}
+	if *pathsMode != "intersect" && *pathsMode != "replace" {
+		failf(fmt.Sprintf("invalid -paths-mode %q: must be 'intersect' or 'replace'", *pathsMode))
+	}
+	for i, ext := range sourceExts {
+		if strings.Trim(ext, ".") == "" {
+			failf(fmt.Sprintf("invalid -source-ext %q", ext))
+		}
+		if !strings.HasPrefix(ext, ".") {
+			sourceExts[i] = "." + ext
+		}
+	}
+	if len(testdataDirs) == 0 {
+		testdataDirs = stringsFlag{"testdata"}
+	}
+	for _, name := range testdataDirs {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			failf(fmt.Sprintf("invalid -testdata-dir %q: must be a single directory name", name))
+		}
+	}
+	if *pathBase != "root" && *pathBase != "cwd" && *pathBase != "absolute" {
+		failf(fmt.Sprintf("invalid -path-base %q: must be 'root', 'cwd' or 'absolute'", *pathBase))
+	}
+	if *shards < 1 || *shard < 0 || *shard >= *shards {
+		failf(fmt.Sprintf("invalid -shard %d of -shards %d: need 0 <= shard < shards", *shard, *shards))
+	}
+	if *sinceLastTag {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "diff" || f.Name == "base-dir" {
+				failf(fmt.Sprintf("-since-last-tag can't be combined with -%s", f.Name))
+			}
+		})
+	}
+	if *baseDir != "" && (*submodules || *movedPackages || *ignoreWhitespace || *diffFilter != "" || len(pathspecs) > 0) {
+		failf("-base-dir can't be combined with -submodules, -moved-packages, -ignore-whitespace, -diff-filter or -pathspec, which need git")
+	}
+	check(validateDiffFilter(*diffFilter))
+	if !formats[*format] {
+		failf(fmt.Sprintf("invalid -format %q", *format))
+	}
+	for _, pattern := range always {
+		if _, err := path.Match(pattern, ""); err != nil {
+			failf(fmt.Sprintf("invalid -always %q: %v", pattern, err))
+		}
+	}
+	if len(always) > 0 && *onlyDirsWithChanges {
+		failf("-always can't be combined with -only-dirs-with-changes, which skips go list")
+	}
+	if *allPackages && *onlyDirsWithChanges {
+		failf("-all-packages can't be combined with -only-dirs-with-changes, which skips go list")
+	}
+	if *onlyDirsWithChanges && (*movedPackages || *benchmarksOnly || *skipBroken || *excludeNoTestDeps) {
+		failf("-only-dirs-with-changes can't be combined with -moved-packages, -benchmarks-only, -skip-broken or -exclude-no-test-deps, which need go list")
+	}
+	if (*gitDir == "") != (*workTree == "") {
+		failf("-git-dir and -work-tree must be set together")
+	}
+	if *gitDir != "" {
+		// Absolute, since some git commands are run from other directories with -C
+		var err error
+		*gitDir, err = filepath.Abs(*gitDir)
+		check(err)
+		*workTree, err = filepath.Abs(*workTree)
+		check(err)
+	}
+	if *changedWithin != "" {
+		if flag.NArg() > 0 {
+			failf("-changed-within can't be combined with <packages>, which it replaces")
+		}
+		*changedWithin = filepath.Clean(*changedWithin)
+		if filepath.IsAbs(*changedWithin) || *changedWithin == ".." || strings.HasPrefix(*changedWithin, ".."+sep) {
+			failf(fmt.Sprintf("invalid -changed-within %q: must be a directory inside the project", *changedWithin))
+		}
+	}
+	if *vetFlags != "" && *format != "govet" {
+		failf("-vet-flags requires -format=govet")
+	}
+	if *splitTestTags && *format != "gotest" {
+		failf("-split-test-tags requires -format=gotest")
+	}
+	if *cover && *format != "gotest" {
+		failf("-cover requires -format=gotest")
+	}
+	if *coverProfile != "" && !*cover {
+		failf("-coverprofile requires -cover")
+	}
+	if *baselineCheck && *baselineFile == "" {
+		failf("-baseline-check requires -baseline-file")
+	}
+	if *outOnly && *out == "" {
+		failf("-out-only requires -out")
+	}
+	if *importPathStyle != "full" && *importPathStyle != "module-relative" {
+		failf(fmt.Sprintf("invalid -importpath-style %q: must be 'full' or 'module-relative'", *importPathStyle))
+	}
+	if !validEnvVar(*envVar) {
+		failf(fmt.Sprintf("invalid -env-var %q: must be a shell variable name", *envVar))
+	}
+
+	if *debug {
+		loggers = append(loggers, LoggerFunc(textLogger))
+	}
+	if *logJSON {
+		loggers = append(loggers, LoggerFunc(jsonLogger))
+	}
+
+	var unresolved []string
+	if *failOnUnresolved {
+		loggers = append(loggers, LoggerFunc(func(e Event) {
+			if e.Kind == eventUnresolved {
+				unresolved = append(unresolved, fmt.Sprintf("%s imports %s: %s", e.Path, e.Trigger, e.Reason))
+			}
+		}))
+	}
+
+	if *profile != "" {
+		f, err := os.Create(*profile)
+		check(err)
+		check(pprof.StartCPUProfile(f))
+		profileFile = f
+		defer stopProfile()
+	}
+
+	var projectDir string
+	if *baseDir != "" {
+		cwd, err := os.Getwd()
+		check(err)
+		projectDir = canonicalPath(cwd)
+	} else {
+		check(gitCheck())
+		if *sinceLastTag {
+			*diff = gitSinceLastTag()
+		}
+		if *commitRangeValidation {
+			check(gitVerifyComparison(*diff, *fetchBase))
+		}
+		projectDir = canonicalPath(gitRoot())
+	}
+
+	if *printRoot || *printCommit {
+		if *printRoot {
+			fmt.Println(projectDir)
+		}
+		if *printCommit {
+			if *baseDir != "" {
+				failf("-print-commit can't be combined with -base-dir, which doesn't diff commits")
+			}
+			fmt.Println(effectiveComparison(*diff))
+		}
+		return
+	}
+	if *classify != "" {
+		abs, err := filepath.Abs(*classify)
+		check(err)
+		file, err := relToRoot(projectDir, abs)
+		check(err)
+		class, dir := classifyFile(file, projectDir)
+		if class == "unmatched" && isAssemblyFile(file) && dirHasAssembly(projectDir, dir) {
+			class = reasonChanged // as pathsImpacted does, without asking go list
+		}
+		fmt.Println(class, "."+sep+dir)
+		return
+	}
+
+	start := time.Now()
+	diffs, renames, reconstrained := StringSet{}, []rename(nil), StringSet{}
+	if !*allPackages {
+		diffs, renames, reconstrained = changedFiles(projectDir)
+	}
+	if *changedWithin != "" {
+		diffs, renames = changesWithin(*changedWithin, diffs, renames)
+	}
+	start = lap("git diff", start)
 	debugDo(func() {
 		fmt.Println("--- git diffs ---")
 		for _, file := range diffs.SortedSlice() {
@@ -42,9 +300,55 @@ func main() {
 		fmt.Println()
 	})
 
-	packages := goList(flag.Args())
+	patterns := flag.Args()
+	if *changedWithin != "" {
+		info, err := os.Stat(filepath.Join(projectDir, *changedWithin))
+		if err != nil || !info.IsDir() {
+			failf(fmt.Sprintf("invalid -changed-within %q: not a directory of the project", *changedWithin))
+		}
+		patterns = []string{filepath.Join(projectDir, *changedWithin) + sep + "..."}
+	}
+
+	var packages []Package
+	var index packageIndex
+	var resolve dirResolver
+	switch {
+	case *onlyDirsWithChanges:
+		// Dependents aren't wanted, so there's nothing to ask go list
+	default:
+		packages, index, resolve = loadPackages(*resolver, patterns, projectDir)
+	}
+	check(patternError(packages))
+	start = lap("go list", start)
+
+	debugDo(func() {
+		fmt.Println("--- package errors ---")
+		for _, pkg := range packages {
+			if pkg.Error != nil {
+				fmt.Printf("%s: %v\n", pkg.ImportPath, pkg.Error)
+			}
+			for _, depErr := range pkg.DepsErrors {
+				fmt.Printf("%s: %v\n", pkg.ImportPath, depErr)
+			}
+		}
+		fmt.Println()
+	})
 
-	impacted := pathsImpacted(packages, diffs)
+	var impacted StringSet
+	var reasons Reasons
+	if *allPackages {
+		impacted, reasons = allPaths(packages, projectDir)
+	} else {
+		impacted, reasons = pathsImpacted(packages, index, diffs, renames, resolve, projectDir)
+	}
+	addAlwaysPaths(impacted, reasons, packages, projectDir)
+	start = lap("impact analysis", start)
+	if len(unresolved) > 0 && !*keepGoing {
+		failf("unresolved imports:\n\t" + strings.Join(unresolved, "\n\t"))
+	}
+	for _, msg := range unresolved {
+		problems = append(problems, errors.New("unresolved import: "+msg))
+	}
 
 	debugDo(func() {
 		fmt.Println("--- paths impacted ---")
@@ -54,15 +358,227 @@ func main() {
 		fmt.Println()
 	})
 
-	removePathsWithoutBuildableGoFiles(impacted)
+	switch {
+	case *noPrune:
+		debugDo(func() {
+			fmt.Println("pruning skipped (-no-prune)")
+			fmt.Println()
+		})
+	case *ascendToPackage:
+		ascendToPackages(impacted, reasons, projectDir)
+		removePathsWithoutBuildableGoFiles(impacted, projectDir)
+		removeUnbuildable(impacted, reconstrained, projectDir)
+	default:
+		removePathsWithoutBuildableGoFiles(impacted, projectDir)
+		removeUnbuildable(impacted, reconstrained, projectDir)
+	}
+	if *withTestsOnly || *format == "test-binaries" {
+		removePathsWithoutTests(impacted, packages, projectDir)
+	}
+	if *excludeNoTestDeps {
+		removeUntestedNonDeps(impacted, packages, index, projectDir)
+	}
+	if *skipBroken {
+		broken := brokenPackages(packages, projectDir)
+		for _, path := range impacted.SortedSlice() {
+			if err, ok := broken[path]; ok {
+				impacted.Del(path)
+				fmt.Fprintf(os.Stderr, "skipping broken package %s: %v\n", "."+sep+path, err)
+			}
+		}
+	}
+	if *benchmarksOnly {
+		benchmarked := packagesWithBenchmarks(packages, projectDir)
+		for path := range impacted {
+			if !benchmarked[path] {
+				impacted.Del(path)
+			}
+		}
+	}
+	if *changedWithin != "" {
+		for path := range impacted {
+			if !isWithin(*changedWithin, path) {
+				impacted.Del(path)
+			}
+		}
+	}
+	start = lap("prune", start)
 
 	debugDo(func() {
-		fmt.Println("--- buildable paths impacted ---")
+		fmt.Println("--- timings ---")
+		for _, t := range timings {
+			fmt.Printf("%s: %v\n", t.phase, t.took)
+		}
+		fmt.Println()
+		if *noPrune {
+			fmt.Println("--- paths impacted (unpruned) ---")
+		} else {
+			fmt.Println("--- buildable paths impacted ---")
+		}
 	})
 
-	for _, path := range impacted.SortedSlice() {
-		fmt.Println("." + sep + path)
+	paths := impacted.SortedSlice()
+	if *shards > 1 {
+		paths = shardPaths(paths, packages, projectDir, *shards, *shard)
+	}
+
+	// Read before -out can overwrite it, so a baseline can be compared and refreshed in one run
+	var baseline StringSet
+	if *baselineFile != "" {
+		var err error
+		baseline, err = readBaseline(*baselineFile)
+		check(err)
+	}
+
+	var w io.Writer = os.Stdout
+	var outFile *os.File
+	if *out != "" {
+		check(os.MkdirAll(filepath.Dir(*out), 0755))
+		var err error
+		outFile, err = os.Create(*out)
+		check(err)
+		if *outOnly {
+			w = outFile
+		} else {
+			w = io.MultiWriter(os.Stdout, outFile)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	check(err)
+	var buf bytes.Buffer
+	dest := w
+	if !*outputTrailingNewline {
+		w = &buf
+	}
+	r := report{
+		projectDir:  projectDir,
+		cwd:         canonicalPath(cwd),
+		paths:       paths,
+		importPaths: importPathsByDir(packages, projectDir),
+		modules:     map[string]Module{},
+		reasons:     reasons,
+		diffs:       diffs,
+	}
+	printImpacted(w, r)
+	if !*outputTrailingNewline {
+		_, err = dest.Write(trimTrailingDelimiter(buf.Bytes()))
+		check(err)
+	}
+	if outFile != nil {
+		check(outFile.Close())
+	}
+	lap("output", start)
+
+	if *verboseTiming {
+		for _, t := range timings {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", t.phase, t.took)
+		}
+	}
+
+	if baseline != nil {
+		added, removed := compareBaseline(baseline, r.displayPaths())
+		for _, path := range added {
+			fmt.Fprintf(os.Stderr, "+ %s\n", path)
+		}
+		for _, path := range removed {
+			fmt.Fprintf(os.Stderr, "- %s\n", path)
+		}
+		if *baselineCheck && len(added)+len(removed) > 0 {
+			failf(fmt.Sprintf("impacted paths differ from -baseline-file %s: %d added, %d removed", *baselineFile, len(added), len(removed)))
+		}
+	}
+
+	if len(problems) > 0 {
+		// The output went to stdout already, so keep the summary out of it
+		fmt.Fprintf(os.Stderr, "problems found with -keep-going:\n%v\n", errors.Join(problems...))
+		exit(1)
+	}
+}
+
+/*
+  Gathers the changed files (relative to the project root) according to the
+  diff flags, along with any renames (for -moved-packages) and the directories
+  whose build constraints changed.
+*/
+func changedFiles(projectDir string) (StringSet, []rename, StringSet) {
+	var diffs StringSet
+	var oldRev, newRev string
+	if *baseDir != "" {
+		var err error
+		diffs, err = dirDifference(*baseDir, projectDir)
+		check(err)
+	} else {
+		diffs = gitAllDiffs(*diff, *diffFilter, pathspecs)
+		if *ignoreWhitespace {
+			for file := range gitWhitespaceOnly(*diff, pathspecs) {
+				diffs.Del(file)
+			}
+		}
+		oldRev, newRev = gitRevisions(*diff)
+	}
+	if *paths != "" {
+		diffs = selectPaths(diffs, *paths, *pathsMode, projectDir)
+	}
+	if *submodules {
+		subDiffs, subPaths := gitSubmoduleDiffs(*diff, projectDir)
+		for path := range subPaths {
+			diffs.Del(path)
+		}
+		diffs.Merge(subDiffs)
+	}
+	var renames []rename
+	if *movedPackages {
+		renames = gitRenames(*diff, pathspecs)
+	}
+	readOld, readNew := dirReader(*baseDir), dirReader(projectDir)
+	if *baseDir == "" {
+		readOld, readNew = revisionReader(oldRev, diffs, projectDir), revisionReader(newRev, diffs, projectDir)
+	}
+	if *ignoreCommentChanges {
+		for file := range cosmeticChanges(diffs, readOld, readNew) {
+			diffs.Del(file)
+			logEvent(Event{Kind: eventClassified, Path: file, Reason: "cosmetic"})
+		}
+	}
+	return diffs, renames, constraintChanges(diffs, readOld, readNew, projectDir)
+}
+
+type timing struct {
+	phase string
+	took  time.Duration
+}
+
+// How long each phase of the run took, in order.
+var timings []timing
+
+// Records how long the named phase took since start and returns the current time, to start timing the next phase.
+func lap(phase string, start time.Time) time.Time {
+	now := time.Now()
+	timings = append(timings, timing{phase, now.Sub(start)})
+	logEvent(Event{Kind: eventPhase, Phase: phase, Took: now.Sub(start)})
+	return now
+}
+
+// A flag.Value that collects every occurrence of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+func (f stringsFlag) Contains(val string) bool {
+	for _, v := range f {
+		if v == val {
+			return true
+		}
 	}
+	return false
 }
 
 type StringSet map[string]bool
@@ -98,142 +614,678 @@ func (set StringSet) Merge(o StringSet) {
 	}
 }
 
-func removePathsWithoutBuildableGoFiles(paths StringSet) {
+/*
+  Narrows the diff to the comma or newline separated list of files. In
+  "intersect" mode only files that git also reports as changed are kept; in
+  "replace" mode the list is used as-is. Files outside of the project root are
+  an error and files git doesn't consider changed produce a warning.
+*/
+func selectPaths(diffs StringSet, list, mode, projectDir string) StringSet {
+	selected := StringSet{}
+	for _, file := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		if filepath.IsAbs(file) {
+			rel, err := filepath.Rel(projectDir, file)
+			check(err)
+			file = rel
+		}
+		file = filepath.ToSlash(filepath.Clean(file))
+		if file == ".." || strings.HasPrefix(file, "../") {
+			failf(fmt.Sprintf("path %q is outside of the project root %s", file, projectDir))
+		}
+
+		if !diffs.Exists(file) {
+			fmt.Fprintf(os.Stderr, "warning: %s is not changed according to git\n", file)
+			if mode == "intersect" {
+				continue
+			}
+		}
+		selected.Add(file)
+	}
+	return selected
+}
+
+const (
+	reasonChanged    = "changed"    // a .go file in the package changed
+	reasonTest       = "test"       // a _test.go file in the package changed
+	reasonTestdata   = "testdata"   // a file in a testdata directory at or beneath the package changed
+	reasonDependency = "dependency" // a dependency or test import of the package was altered
+	reasonAll        = "all"        // -all-packages lists every package
+	reasonAlways     = "always"     // the package matches an -always glob
+)
+
+// The order of precedence when a path is impacted for more than one reason.
+var reasonRanks = map[string]int{
+	reasonChanged:    3,
+	reasonTest:       2,
+	reasonTestdata:   1,
+	reasonDependency: 0,
+	reasonAlways:     -1,
+}
+
+/*
+  Why a path was impacted: the kind of rule that matched and the file or
+  altered package path that triggered it. For dependents, Deps lists the paths
+  of every altered dependency, of which Trigger is the first found. A moved
+  package is listed by its new path.
+*/
+type Reason struct {
+	Kind    string
+	Trigger string
+	Deps    []string
+}
+
+type Reasons map[string]Reason
+
+// Records the reason for path, keeping whichever reason ranks highest.
+func (reasons Reasons) Add(path string, reason Reason) {
+	if existing, ok := reasons[path]; ok && reasonRanks[existing.Kind] >= reasonRanks[reason.Kind] {
+		return
+	}
+	reasons[path] = reason
+	logEvent(Event{Kind: eventImpacted, Path: path, Reason: reason.Kind, Trigger: reason.Trigger})
+}
+
+func removePathsWithoutBuildableGoFiles(paths StringSet, projectDir string) {
+	fsys := os.DirFS(projectDir)
 	for path := range paths {
-		infos, err := ioutil.ReadDir(path)
-		if err != nil {
+		if !hasBuildableGoFiles(fsys, path) {
 			paths.Del(path)
 		}
-		var hasBuildableGoFiles bool
-		for _, info := range infos {
-			if strings.HasSuffix(info.Name(), ".go") {
-				hasBuildableGoFiles = true
+	}
+}
+
+// Keeps only the changed files, and renames into, the dir subtree, for -changed-within.
+func changesWithin(dir string, diffs StringSet, renames []rename) (StringSet, []rename) {
+	within := StringSet{}
+	for file := range diffs {
+		if isWithin(dir, filepath.FromSlash(file)) {
+			within.Add(file)
+		}
+	}
+	var renamesWithin []rename
+	for _, mv := range renames {
+		if isWithin(dir, filepath.FromSlash(mv.to)) {
+			renamesWithin = append(renamesWithin, mv)
+		}
+	}
+	return within, renamesWithin
+}
+
+// Reports whether path (relative to the project root) is dir or beneath it.
+func isWithin(dir, path string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+sep)
+}
+
+/*
+  Replaces each path that has no buildable go files (eg: foo/migrations) with
+  its nearest ancestor that does (eg: foo), carrying over the reason it was
+  impacted. Paths with no such ancestor are left for pruning.
+*/
+func ascendToPackages(paths StringSet, reasons Reasons, projectDir string) {
+	fsys := os.DirFS(projectDir)
+	for _, path := range paths.SortedSlice() {
+		if hasBuildableGoFiles(fsys, path) {
+			continue
+		}
+		for dir := path; dir != "."; {
+			dir = filepath.Dir(dir)
+			if hasBuildableGoFiles(fsys, dir) {
+				paths.Del(path)
+				paths.Add(dir)
+				reasons.Add(dir, reasons[path])
 				break
 			}
 		}
-		if !hasBuildableGoFiles {
+	}
+}
+
+/*
+  Directory scans take an fs.FS rooted at the project dir, with paths relative
+  to the project root, so they can run against something other than the OS
+  (eg: an fstest.MapFS or an overlay of unsaved editor buffers).
+*/
+func hasBuildableGoFiles(fsys fs.FS, path string) bool {
+	entries, err := fs.ReadDir(fsys, filepath.ToSlash(path))
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the paths without test files that build on this platform, for -with-tests-only.
+func removePathsWithoutTests(paths StringSet, packages []Package, projectDir string) {
+	testable := packagesWithTests(packages, projectDir)
+	for path := range paths {
+		if !hasTests(testable, projectDir, path) {
 			paths.Del(path)
 		}
 	}
 }
 
-func hasTestFiles(path string) bool {
-	infos, err := ioutil.ReadDir(path)
-	check(err)
-	for _, info := range infos {
-		if strings.HasSuffix(info.Name(), "_test.go") && info.Name()[0] != '.' && info.Name()[0] != '_' {
+/*
+  Maps the directory (relative to the project root) of each listed package to
+  whether it has test files that build on this platform, according to go list.
+*/
+func packagesWithTests(packages []Package, projectDir string) map[string]bool {
+	testable := map[string]bool{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		testable[rel] = len(pkg.TestGoFiles) > 0 || len(pkg.XTestGoFiles) > 0
+	}
+	return testable
+}
+
+// Maps the directory (relative to the project root) of each listed package that fails to load or build to its first error.
+func brokenPackages(packages []Package, projectDir string) map[string]error {
+	broken := map[string]error{}
+	for _, pkg := range packages {
+		var err error
+		switch {
+		case pkg.Error != nil:
+			err = pkg.Error
+		case len(pkg.DepsErrors) > 0:
+			err = pkg.DepsErrors[0]
+		default:
+			continue
+		}
+		rel, relErr := relToRoot(projectDir, pkg.Dir)
+		if relErr != nil {
+			continue
+		}
+		broken[rel] = err
+	}
+	return broken
+}
+
+/*
+  Finds the directories (relative to the project root) of listed packages with
+  test files that declare at least one Benchmark function. A test file that
+  fails to parse is assumed to have benchmarks.
+*/
+func packagesWithBenchmarks(packages []Package, projectDir string) map[string]bool {
+	benchmarked := map[string]bool{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range concat(pkg.TestGoFiles, pkg.XTestGoFiles) {
+			if hasBenchmarks(filepath.Join(pkg.Dir, file)) {
+				benchmarked[rel] = true
+				break
+			}
+		}
+	}
+	return benchmarked
+}
+
+func hasBenchmarks(file string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		return true
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "Benchmark") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  Prefers go list's view of the package at path, falling back to scanning the
+  directory for packages go list didn't report. Scanned results are cached in
+  testable, so walking up from many testdata changes that share ancestors reads
+  each directory at most once per run.
+*/
+func hasTests(testable map[string]bool, projectDir, path string) bool {
+	if hasTests, ok := testable[path]; ok {
+		return hasTests
+	}
+	testable[path] = hasTestFiles(os.DirFS(projectDir), path)
+	return testable[path]
+}
+
+func hasTestFiles(fsys fs.FS, path string) bool {
+	entries, err := fs.ReadDir(fsys, filepath.ToSlash(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false // eg: a deleted package kept by -no-prune
+	}
+	if err != nil {
+		problem(err)
+		return false
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, "_test.go") && name[0] != '.' && name[0] != '_' {
 			return true
 		}
 	}
 	return false
 }
 
-func pathsImpacted(packages []Package, diffs StringSet) StringSet {
+/*
+  Classifies a changed file (relative to the project root) and returns the
+  directory it belongs to, relative to the project root. The rules are:
+  - If a file is ignored by the go tool, then we ignore it too ("ignored").
+  - If a file is a test file, then of course its directory needs testing ("test").
+  - If a file is inside a testdata directory, then the directory holding
+    testdata and its ancestors need testing ("testdata"). The directory
+    returned is the one holding testdata.
+  - If a file is a .go file (or has an extension passed with -source-ext), its
+    package is altered ("changed").
+  Anything else is "unmatched". pathsImpacted also treats unmatched assembly
+  files as "changed" in packages that go list says have them.
+*/
+func classifyFile(file, projectDir string) (string, string) {
+	basename := filepath.Base(file)
+	dir := fileDir(projectDir, file)
+	testdataParent, inTestdata := testdataParentDir(dir)
+	switch {
+	case strings.HasPrefix(basename, "."):
+		// The go tool ignores "dot" files and so shall we
+		return "ignored", dir
+	case strings.HasPrefix(basename, "_"):
+		// The go tool ignores files with "_" prefixes and so shall we
+		return "ignored", dir
+	case strings.HasSuffix(basename, "_test.go"):
+		// Good to ".go"! Get it? It's funny cuz it's Go...
+		return reasonTest, dir
+	case inTestdata:
+		return reasonTestdata, testdataParent
+	case strings.HasSuffix(basename, ".go"):
+		return reasonChanged, dir
+	case sourceExts.Contains(filepath.Ext(basename)):
+		// Non-go sources (eg: embedded .sql files) are treated as part of the package in their directory
+		return reasonChanged, dir
+	}
+	return "unmatched", dir
+}
+
+// Treats every listed package as impacted, for -all-packages.
+func allPaths(packages []Package, projectDir string) (StringSet, Reasons) {
+	paths, reasons := StringSet{}, Reasons{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		paths.Add(rel)
+		reasons.Add(rel, Reason{Kind: reasonAll})
+	}
+	return paths, reasons
+}
+
+/*
+  Removes the impacted paths that have no tests and that no impacted package
+  with tests imports, directly or indirectly (including through its test
+  imports), for -exclude-no-test-deps. What's left either runs tests or is
+  needed to build them, so compile errors in the dropped packages are only
+  caught if something else builds them.
+*/
+func removeUntestedNonDeps(paths StringSet, packages []Package, index packageIndex, projectDir string) {
+	testable := packagesWithTests(packages, projectDir)
+	needed := StringSet{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil || !paths.Exists(rel) || !testable[rel] {
+			continue
+		}
+		for _, dep := range concat(pkg.Deps, pkg.TestImports, pkg.XTestImports) {
+			needed.Add(dep)
+			// Deps is only the non-test imports, so add what the test imports need in turn
+			needed.Add(index[dep].Deps...)
+		}
+	}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil || !paths.Exists(rel) || testable[rel] || needed.Exists(pkg.ImportPath) {
+			continue
+		}
+		paths.Del(rel)
+		logEvent(Event{Kind: eventPruned, Path: rel, Reason: "no tests, and no impacted package with tests depends on it"})
+	}
+}
+
+/*
+  Indexes packages by whether go list reports assembly (SFiles) or system
+  object (SysoFiles) files in them. Only in those packages does a changed .s,
+  .S or .syso file alter the package, since elsewhere the go tool ignores them.
+*/
+func packagesWithAssembly(packages []Package, projectDir string) map[string]bool {
+	assembled := map[string]bool{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		assembled[rel] = len(pkg.SFiles) > 0 || len(pkg.SysoFiles) > 0
+	}
+	return assembled
+}
+
+/*
+  Reports whether the package in dir (relative to the project root) builds
+  assembly or system object files on this platform, as go/build sees it. This
+  stands in for packagesWithAssembly where go list isn't run (eg: -classify).
+*/
+func dirHasAssembly(projectDir, dir string) bool {
+	pkg, err := build.ImportDir(filepath.Join(projectDir, dir), 0)
+	return err == nil && len(pkg.SFiles)+len(pkg.SysoFiles) > 0
+}
+
+func isAssemblyFile(file string) bool {
+	switch filepath.Ext(file) {
+	case ".s", ".S", ".syso":
+		return true
+	}
+	return false
+}
+
+/*
+  Adds the packages matching an -always glob to paths, whatever the diff. The
+  globs are matched (as by path.Match) against each package's directory
+  relative to the project root, with forward slashes. Packages that were
+  impacted anyway keep their own reason.
+*/
+func addAlwaysPaths(paths StringSet, reasons Reasons, packages []Package, projectDir string) {
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		for _, pattern := range always {
+			if matched, _ := path.Match(pattern, filepath.ToSlash(rel)); matched {
+				paths.Add(rel)
+				reasons.Add(rel, Reason{Kind: reasonAlways, Trigger: pattern})
+				break
+			}
+		}
+	}
+}
+
+func pathsImpacted(packages []Package, index packageIndex, diffs StringSet, renames []rename, resolve dirResolver, projectDir string) (StringSet, Reasons) {
 	// ie: locations that need testing
 	impactedPaths := StringSet{}
 	// ie: go code that's filed
 	alteredPaths := StringSet{}
+	// ie: why each location needs testing
+	reasons := Reasons{}
+	// ie: import paths of altered packages, from which -depth counts
+	alteredImportPaths := StringSet{}
+	// ie: locations with tests that build on this platform
+	testable := packagesWithTests(packages, projectDir)
+	assembled := packagesWithAssembly(packages, projectDir)
 
-	projectDir := gitRoot()
-	for file := range diffs {
-		/*
-			The following is a set of rules for how to handle different types of diffs:
-			- If a file is ignored by the go tool, then we ignore it too.
-			- If a file is inside a testdata directory, then we mark all ancestors of testdata as impacted
-			- If a file is a test file, then of course we mark that path as impacted
-			- If a file is a .go file, then we mark that path as impacted AND altered
-		*/
-		basename := filepath.Base(file)
-		dir := filepath.Dir(file)
+	for _, file := range diffs.SortedSlice() {
+		class, dir := classifyFile(file, projectDir)
+		if class == "unmatched" && assembled[dir] && isAssemblyFile(file) {
+			// eg: an edited amd64.s whose go stub didn't change
+			class = reasonChanged
+		}
 		switch {
-		case strings.HasPrefix(basename, "."):
-			// The go tool ignores "dot" files and so shall we
-			continue
-		case strings.HasPrefix(basename, "_"):
-			// The go tool ignores files with "_" prefixes and so shall we
-			continue
-		case strings.HasSuffix(basename, "_test.go"):
-			// Good to ".go"! Get it? It's funny cuz it's Go...
+		case class == reasonTest:
 			impactedPaths.Add(dir)
-			continue
-		case strings.HasPrefix(dir, testdataPattern1):
+			reasons.Add(dir, Reason{Kind: reasonTest, Trigger: file})
+		case class == reasonTestdata && dir == ".":
 			// Then the project root needs testing (eg: testdata/foo/bar.txt)
-			if hasTestFiles(".") {
+			if hasTests(testable, projectDir, ".") {
 				impactedPaths.Add(".")
+				reasons.Add(".", Reason{Kind: reasonTestdata, Trigger: file})
 			}
-			continue
-		case strings.Contains(dir, testdataPattern2):
+		case class == reasonTestdata:
 			// Changes to "testdata" directories impact tests in the parent directory and all ancestor dirs.
 			// (eg: foo/testdata/bar.txt)
-			for parentDir := dir[:strings.Index(dir, testdataPattern2)]; parentDir != "."; parentDir = filepath.Dir(parentDir) {
-				if hasTestFiles(parentDir) {
+			for parentDir := dir; parentDir != "."; parentDir = filepath.Dir(parentDir) {
+				if hasTests(testable, projectDir, parentDir) {
 					impactedPaths.Add(parentDir)
+					reasons.Add(parentDir, Reason{Kind: reasonTestdata, Trigger: file})
 				}
 			}
-			continue
-		case strings.HasSuffix(basename, ".go"):
+		case class == reasonChanged:
 			impactedPaths.Add(dir)
 			alteredPaths.Add(dir)
+			reasons.Add(dir, Reason{Kind: reasonChanged, Trigger: file})
+		}
+		logEvent(Event{Kind: eventClassified, Path: file, Reason: class})
+	}
+
+	// ie: import paths of packages that moved away, which importers may still refer to, and where they went
+	movedImportPaths := map[string]string{}
+	importPaths := importPathsByDir(packages, projectDir)
+	for _, mv := range renames {
+		if !strings.HasSuffix(mv.from, ".go") || strings.HasSuffix(mv.from, "_test.go") {
+			continue
+		}
+		fromDir, toDir := fileDir(projectDir, mv.from), fileDir(projectDir, mv.to)
+		toImportPath, ok := importPaths[toDir]
+		if fromDir == toDir || !ok || !strings.HasSuffix(toImportPath, filepath.ToSlash(toDir)) {
 			continue
 		}
+		// The old import path is the new one with the directory swapped back (eg: example.com/z -> example.com/a)
+		fromImportPath := strings.TrimSuffix(toImportPath, filepath.ToSlash(toDir)) + filepath.ToSlash(fromDir)
+		movedImportPaths[fromImportPath] = toDir
+		alteredPaths.Add(toDir)
+		impactedPaths.Add(toDir)
+		reasons.Add(toDir, Reason{Kind: reasonChanged, Trigger: mv.to})
 	}
 
 	for _, pkg := range packages {
-		func() {
-			// Check if this package itself was altered
-			pkgRelativePath, err := filepath.Rel(projectDir, pkg.Dir)
-			check(err)
+		pkgRelativePath, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
 
-			if alteredPaths.Exists(pkgRelativePath) {
-				impactedPaths.Add(pkgRelativePath)
-				return
-			}
+		// Check if this package itself was altered
+		if alteredPaths.Exists(pkgRelativePath) {
+			impactedPaths.Add(pkgRelativePath)
+			alteredImportPaths.Add(pkg.ImportPath)
+			continue
+		}
 
-			// Check the package's dependencies to see if any were altered
-			for _, dep := range pkg.Deps {
-				buildPkg, err := build.Import(dep, projectDir, build.FindOnly)
-				check(err)
+		// Check the package's dependencies, test imports and external test imports to see if any were altered.
+		// Deps doesn't cover what the test imports import in turn (eg: a shared test helper package and its own
+		// dependencies), so add the Deps of those that are among the listed packages.
+		var testDeps []string
+		for _, testImport := range concat(pkg.TestImports, pkg.XTestImports) {
+			testDeps = append(testDeps, index[testImport].Deps...)
+		}
+		var alteredDeps []string
+		seen := StringSet{}
+		for _, dep := range concat(pkg.Deps, pkg.TestImports, pkg.XTestImports, testDeps) {
+			if seen.Exists(dep) {
+				continue
+			}
+			seen.Add(dep)
 
-				depRelativePath, err := filepath.Rel(projectDir, buildPkg.Dir)
-				check(err)
+			if toDir, ok := movedImportPaths[dep]; ok {
+				alteredDeps = append(alteredDeps, toDir)
+				alteredImportPaths.Add(dep)
+				continue
+			}
 
-				if alteredPaths.Exists(depRelativePath) {
-					impactedPaths.Add(depRelativePath)
-					return
-				}
+			depDir, err := resolve(dep)
+			if err != nil {
+				// Broken imports are reported by go list; they can't have been altered locally
+				logEvent(Event{Kind: eventUnresolved, Path: pkg.ImportPath, Reason: err.Error(), Trigger: dep})
+				continue
 			}
 
-			// Check the package's test imports to see if any were altered
-			for _, dep := range pkg.TestImports {
-				buildPkg, err := build.Import(dep, projectDir, build.FindOnly)
-				check(err)
+			depRelativePath, err := relToRoot(projectDir, depDir)
+			if err != nil {
+				// Outside of the project (eg: in a module cache on another volume), so it can't have been altered locally
+				continue
+			}
 
-				depRelativePath, err := filepath.Rel(projectDir, buildPkg.Dir)
-				check(err)
+			if alteredPaths.Exists(depRelativePath) {
+				alteredDeps = append(alteredDeps, depRelativePath)
+				alteredImportPaths.Add(dep)
+			}
+		}
+		if len(alteredDeps) > 0 {
+			impactedPaths.Add(pkgRelativePath)
+			reasons.Add(pkgRelativePath, Reason{Kind: reasonDependency, Trigger: alteredDeps[0], Deps: alteredDeps})
+		}
+	}
 
-				if alteredPaths.Exists(depRelativePath) {
-					impactedPaths.Add(depRelativePath)
-					return
-				}
+	if *depth >= 0 {
+		depths := dependentDepths(packages, index, alteredImportPaths)
+		for _, pkg := range packages {
+			pkgRelativePath, err := relToRoot(projectDir, pkg.Dir)
+			if err != nil {
+				continue
 			}
+			if reasons[pkgRelativePath].Kind != reasonDependency {
+				continue
+			}
+			if d, ok := depths[pkg.ImportPath]; !ok || d > *depth {
+				impactedPaths.Del(pkgRelativePath)
+				delete(reasons, pkgRelativePath)
+				logEvent(Event{Kind: eventPruned, Path: pkgRelativePath, Reason: fmt.Sprintf("more than -depth=%d imports away from an altered package", *depth)})
+			}
+		}
+	}
 
-			// Check the package's external test imports to see if any were altered
-			for _, dep := range pkg.XTestImports {
-				buildPkg, err := build.Import(dep, projectDir, build.FindOnly)
-				check(err)
+	return impactedPaths, reasons
+}
 
-				depRelativePath, err := filepath.Rel(projectDir, buildPkg.Dir)
-				check(err)
+/*
+  Counts the fewest imports between each listed package and an altered one,
+  with a breadth-first search of the reverse import graph. Test imports make
+  the importing package a dependent, but not that package's importers, so they
+  only count for the final hop. Hops are counted through every package in the
+  index, so a chain through packages <packages> didn't match is still followed
+  (except with -resolver=gobuild, whose index only holds the matched ones).
+*/
+func dependentDepths(packages []Package, index packageIndex, altered StringSet) map[string]int {
+	importers := map[string][]string{}
+	for _, pkg := range index {
+		for _, imp := range pkg.Imports {
+			importers[imp] = append(importers[imp], pkg.ImportPath)
+		}
+	}
 
-				if alteredPaths.Exists(depRelativePath) {
-					impactedPaths.Add(depRelativePath)
-					return
-				}
+	depths := map[string]int{}
+	queue := altered.SortedSlice()
+	for _, importPath := range queue {
+		depths[importPath] = 0
+	}
+	for len(queue) > 0 {
+		importPath := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[importPath] {
+			if _, ok := depths[importer]; !ok {
+				depths[importer] = depths[importPath] + 1
+				queue = append(queue, importer)
 			}
-		}()
+		}
+	}
+
+	testDepths := map[string]int{}
+	for _, pkg := range packages {
+		for _, imp := range concat(pkg.TestImports, pkg.XTestImports) {
+			d, ok := depths[imp]
+			if !ok {
+				continue
+			}
+			if existing, ok := testDepths[pkg.ImportPath]; !ok || d+1 < existing {
+				testDepths[pkg.ImportPath] = d + 1
+			}
+		}
+	}
+	for importPath, d := range testDepths {
+		if existing, ok := depths[importPath]; !ok || d < existing {
+			depths[importPath] = d
+		}
+	}
+	return depths
+}
+
+/*
+  If dir is (or is beneath) a directory named by -testdata-dir, returns the
+  directory containing the outermost such testdata directory, eg:
+
+    "foo/testdata"         -> "foo", true
+    "foo/testdata/bar/baz" -> "foo", true
+    "testdata/bar"         -> ".", true
+    "foo/bar"              -> "", false
+*/
+func testdataParentDir(dir string) (string, bool) {
+	parts := strings.Split(dir, sep)
+	for i, part := range parts {
+		if testdataDirs.Contains(part) {
+			return filepath.Join(append([]string{"."}, parts[:i]...)...), true
+		}
 	}
+	return "", false
+}
+
+// Resolves any symlinks in path, returning it unchanged when it can't be resolved (eg: it was deleted).
+func canonicalPath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	// Deleted paths can't be resolved, but their nearest existing ancestor can (eg: a removed package in a symlinked dir)
+	if parent := filepath.Dir(path); parent != path {
+		return filepath.Join(canonicalPath(parent), filepath.Base(path))
+	}
+	return path
+}
+
+/*
+  Returns the symlink-free form of the absolute path dir, relative to the
+  (already canonical) projectDir. Every path added to the impacted set goes
+  through here, so the same directory always has the same key whether it came
+  from a git diff or from go list.
 
-	return impactedPaths
+  On Windows this fails for a dir on another volume than projectDir (eg: a
+  module cache on D:). Such packages are outside the project and can't have
+  been altered locally, so callers skip them rather than aborting.
+*/
+func relToRoot(projectDir, dir string) (string, error) {
+	return filepath.Rel(projectDir, canonicalPath(dir))
+}
+
+// Returns the canonical directory (relative to the project root) of a file relative to the project root.
+func fileDir(projectDir, file string) string {
+	dir, err := relToRoot(projectDir, filepath.Join(projectDir, filepath.Dir(filepath.FromSlash(file))))
+	check(err)
+	return dir
+}
+
+// Describes this build of slim, eg: "slim v1.2.3 (go1.22.1)"
+func versionString() string {
+	version, goVersion := Version, runtime.Version()
+	if info, ok := runtimedebug.ReadBuildInfo(); ok {
+		if version == "" {
+			version = info.Main.Version // a pseudo-version or "(devel)" when built from a checkout
+		}
+		goVersion = info.GoVersion
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	return fmt.Sprintf("slim %s (%s)", version, goVersion)
+}
+
+func concat(slices ...[]string) []string {
+	var all []string
+	for _, slice := range slices {
+		all = append(all, slice...)
+	}
+	return all
 }
 
 func debugDo(fn func()) {
@@ -242,28 +1294,90 @@ func debugDo(fn func()) {
 	}
 }
 
+var errShellFailed = errors.New("command failed")
+
+/*
+  Runs a command and returns its stdout, exiting on failure. The error names
+  the command and wraps both the cause and a sentinel for the tool that
+  failed (errGitFailed, errGoListFailed), eg:
+
+    git failed: git diff --name-only main: exit status 128
+*/
 func shell(executable string, args ...string) []byte {
+	output, err := tryShell(executable, args...)
+	check(err)
+	return output
+}
+
+// Like shell, but returns the error rather than exiting.
+func tryShell(executable string, args ...string) ([]byte, error) {
 	cmd := exec.Command(executable, args...)
 	cmd.Stderr = os.Stderr
 	output, err := cmd.Output()
-	check(err)
-	return output
+	if err != nil {
+		sentinel := errShellFailed
+		switch {
+		case executable == "git":
+			sentinel = errGitFailed
+		case executable == "go" && len(args) > 0 && args[0] == "list":
+			sentinel = errGoListFailed
+		}
+		return nil, fmt.Errorf("%w: %s: %w", sentinel, strings.Join(cmd.Args, " "), err)
+	}
+	return output, nil
 }
 
 func check(err error) {
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		exit(1)
 	}
 }
 
 func failf(err string) {
 	fmt.Println(err)
-	os.Exit(1)
+	exit(1)
 }
 
-func printJSON(v interface{}) error {
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "\t")
+// The -profile file, while profiling.
+var profileFile *os.File
+
+// Writes out the -profile CPU profile, if one is being taken.
+func stopProfile() {
+	if profileFile == nil {
+		return
+	}
+	pprof.StopCPUProfile()
+	profileFile.Close()
+	profileFile = nil
+}
+
+// Exits with code, first stopping the profile since os.Exit skips deferred calls.
+func exit(code int) {
+	stopProfile()
+	os.Exit(code)
+}
+
+// The non-fatal errors collected with -keep-going, reported once the output has been written.
+var problems []error
+
+/*
+  Reports an error that only spoils part of the analysis (eg: one submodule).
+  With -keep-going it's collected for the end of the run and the caller
+  carries on best-effort; otherwise it's fatal, like check.
+*/
+func problem(err error) {
+	if !*keepGoing {
+		check(err)
+	}
+	problems = append(problems, err)
+}
+
+// Writes v as tab indented JSON, or on a single line with -json-compact.
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	if !*jsonCompact {
+		enc.SetIndent("", "\t")
+	}
 	return enc.Encode(v)
 }
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+// Writes files (keyed by slash separated paths relative to dir) beneath dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Runs a command in dir, failing the test if it does.
+func run(t *testing.T, dir, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s %v: %v\n%s", name, args, err, output)
+	}
+}
+
+// Skips the test unless the named tools are on the PATH.
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found: %v", tool, err)
+		}
+	}
+}
+
+// Changes the working directory for the rest of the test, since git and go list run in it.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(old)
+	})
+}
+
+/*
+  Creates a module (example.com/fx) from files in a new git repository with
+  everything committed, makes it the working directory and returns its
+  canonical path.
+*/
+func gitFixture(t *testing.T, files map[string]string) string {
+	t.Helper()
+	requireTools(t, "git", "go")
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GIT_AUTHOR_NAME", "slim")
+	t.Setenv("GIT_AUTHOR_EMAIL", "slim@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "slim")
+	t.Setenv("GIT_COMMITTER_EMAIL", "slim@example.com")
+	dir := canonicalPath(t.TempDir())
+	writeFiles(t, dir, map[string]string{"go.mod": "module example.com/fx\n\ngo 1.20\n"})
+	writeFiles(t, dir, files)
+	run(t, dir, "git", "init", "-q")
+	run(t, dir, "git", "add", "-A")
+	run(t, dir, "git", "commit", "-q", "-m", "fixture")
+	chdir(t, dir)
+	return dir
+}
+
+// Lists the packages beneath projectDir and returns the paths impacted by diffs, pruned as by default.
+func impactedPaths(t *testing.T, resolver string, diffs StringSet, projectDir string) []string {
+	t.Helper()
+	packages, index, resolve := loadPackages(resolver, []string{"./..."}, projectDir)
+	if err := patternError(packages); err != nil {
+		t.Fatal(err)
+	}
+	impacted, _ := pathsImpacted(packages, index, diffs, nil, resolve, projectDir)
+	removePathsWithoutBuildableGoFiles(impacted, projectDir)
+	return impacted.SortedSlice()
+}
+
+// The packages of the fixtures: b imports a, and the tests of c import b.
+var abcFiles = map[string]string{
+	"a/a.go":      "package a\n",
+	"b/b.go":      "package b\n\nimport _ \"example.com/fx/a\"\n",
+	"c/c.go":      "package c\n",
+	"c/c_test.go": "package c\n\nimport (\n\t\"testing\"\n\n\t_ \"example.com/fx/b\"\n)\n\nfunc TestC(t *testing.T) {}\n",
+}
+
+// Sets the repeatable flags that classification reads for the rest of the test.
+func setClassifyFlags(t *testing.T, testdata, exts stringsFlag) {
+	oldTestdata, oldExts := testdataDirs, sourceExts
+	testdataDirs, sourceExts = testdata, exts
+	t.Cleanup(func() {
+		testdataDirs, sourceExts = oldTestdata, oldExts
+	})
+}
+
+func TestClassifyFile(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata", "fixtures"}, stringsFlag{".sql"})
+	projectDir := canonicalPath(t.TempDir())
+
+	tests := []struct {
+		file      string
+		wantClass string
+		wantDir   string
+	}{
+		{"foo/.hidden.go", "ignored", "foo"},
+		{"foo/_ignored.go", "ignored", "foo"},
+		{"foo/_ignored_test.go", "ignored", "foo"},
+		{"foo/foo_test.go", reasonTest, "foo"},
+		{"foo_test.go", reasonTest, "."},
+		{"foo/testdata/golden.txt", reasonTestdata, "foo"},
+		{"foo/bar/testdata/nested/golden.go", reasonTestdata, filepath.Join("foo", "bar")},
+		{"testdata/golden.txt", reasonTestdata, "."},
+		{"foo/fixtures/golden.json", reasonTestdata, "foo"},
+		{"foo/testdata/helper_test.go", reasonTest, filepath.Join("foo", "testdata")},
+		{"foo/foo.go", reasonChanged, "foo"},
+		{"main.go", reasonChanged, "."},
+		{"foo/schema.sql", reasonChanged, "foo"},
+		{"foo/README.md", "unmatched", "foo"},
+		{"foo/amd64.s", "unmatched", "foo"},
+	}
+	for _, test := range tests {
+		class, dir := classifyFile(test.file, projectDir)
+		if class != test.wantClass || dir != test.wantDir {
+			t.Errorf("classifyFile(%q) = %q, %q, want %q, %q", test.file, class, dir, test.wantClass, test.wantDir)
+		}
+	}
+}
+
+func TestTestdataParentDir(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata", "fixtures"}, nil)
+
+	tests := []struct {
+		dir        string
+		wantParent string
+		wantOK     bool
+	}{
+		{"foo/testdata", "foo", true},
+		{"foo/testdata/bar/baz", "foo", true},
+		{"testdata/bar", ".", true},
+		{"foo/fixtures", "foo", true},
+		{"foo/bar/fixtures/golden", "foo/bar", true},
+		{"fixtures", ".", true},
+		{"foo/my-fixtures", "", false},
+		{"foo/_testdata", "", false},
+		{"foo/bar", "", false},
+	}
+	for _, test := range tests {
+		parent, ok := testdataParentDir(filepath.FromSlash(test.dir))
+		if parent != filepath.FromSlash(test.wantParent) || ok != test.wantOK {
+			t.Errorf("testdataParentDir(%q) = %q, %v, want %q, %v", test.dir, parent, ok, test.wantParent, test.wantOK)
+		}
+	}
+}
+
+/*
+  A project reached through a symlink (eg: a workspace linked into place)
+  has go list report package dirs beneath the link, while the project root is
+  resolved. Both must be canonicalized to compare.
+*/
+func TestSymlinkedProject(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	projectDir := gitFixture(t, abcFiles)
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(projectDir, link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	chdir(t, link)
+
+	root := canonicalPath(gitRoot())
+	if root != projectDir {
+		t.Fatalf("project root from within the link = %q, want %q", root, projectDir)
+	}
+	diffs := StringSet{}
+	diffs.Add("a/a.go")
+	want := []string{"a", "b", "c"}
+	for _, resolver := range []string{"golist", "gobuild"} {
+		if got := impactedPaths(t, resolver, diffs, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s resolver: changing a/a.go through a symlinked project impacted %q, want %q", resolver, got, want)
+		}
+	}
+}
+
+// A package dir that is itself a symlink belongs to the directory it points at.
+func TestSymlinkedPackageDir(t *testing.T) {
+	projectDir := canonicalPath(t.TempDir())
+	writeFiles(t, projectDir, map[string]string{"real/real.go": "package real\n"})
+	if err := os.Symlink(filepath.Join(projectDir, "real"), filepath.Join(projectDir, "alias")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	rel, err := relToRoot(projectDir, filepath.Join(projectDir, "alias"))
+	if err != nil || rel != "real" {
+		t.Errorf("relToRoot(alias) = %q, %v, want %q", rel, err, "real")
+	}
+	fsys := os.DirFS(projectDir)
+	if !hasBuildableGoFiles(fsys, "alias") {
+		t.Error("hasBuildableGoFiles(alias) = false, want true")
+	}
+}
+
+/*
+  The same directory reached from a git path (slash separated, relative) and
+  from a go list Dir (absolute, maybe through a symlink) must get one key.
+*/
+func TestPathsCanonicalizeToOneKey(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	projectDir := gitFixture(t, abcFiles)
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(projectDir, link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	for _, file := range []string{"b/b.go", "./b/b.go", "b//b.go", "c/../b/b.go"} {
+		if dir := fileDir(projectDir, file); dir != "b" {
+			t.Errorf("fileDir(%q) = %q, want %q", file, dir, "b")
+		}
+	}
+	for _, dir := range []string{filepath.Join(link, "b"), filepath.Join(link, "b") + sep, filepath.Join(projectDir, "b")} {
+		if rel, err := relToRoot(projectDir, dir); err != nil || rel != "b" {
+			t.Errorf("relToRoot(%q) = %q, %v, want %q", dir, rel, err, "b")
+		}
+	}
+
+	// b is both altered itself (from the diff) and a dependent of a (from go list, through the link)
+	chdir(t, link)
+	diffs := StringSet{}
+	diffs.Add("a/a.go", "b/b.go")
+	packages, index, resolve := loadPackages("golist", []string{"./..."}, projectDir)
+	renames := []rename{{from: "z/b.go", to: "b/b.go"}}
+	impacted, reasons := pathsImpacted(packages, index, diffs, renames, resolve, projectDir)
+	if got, want := impacted.SortedSlice(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("impacted %q, want %q", got, want)
+	}
+	if reasons["b"].Kind != reasonChanged {
+		t.Errorf("b impacted as %q, want %q", reasons["b"].Kind, reasonChanged)
+	}
+}
+
+/*
+  On Windows a dir on another volume can't be made relative to the project
+  root. filepath.Rel fails the same way for a relative dir, which stands in
+  for one here: such packages and deps are skipped, not fatal.
+*/
+func TestDirsNotRelativeToRootAreSkipped(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	projectDir := canonicalPath(t.TempDir())
+	elsewhere := filepath.Join("other-volume", "ext")
+	if _, err := relToRoot(projectDir, elsewhere); err == nil {
+		t.Fatalf("relToRoot(%q) succeeded, so it can't stand in for another volume", elsewhere)
+	}
+
+	packages := []Package{
+		{Dir: filepath.Join(projectDir, "a"), ImportPath: "example.com/fx/a"},
+		{Dir: filepath.Join(projectDir, "b"), ImportPath: "example.com/fx/b", Deps: []string{"example.com/ext", "example.com/fx/a"}},
+		{Dir: elsewhere, ImportPath: "example.com/ext", Deps: []string{"example.com/fx/a"}},
+	}
+	resolve := func(importPath string) (string, error) {
+		for _, pkg := range packages {
+			if pkg.ImportPath == importPath {
+				return pkg.Dir, nil
+			}
+		}
+		return "", fmt.Errorf("cannot find package %q", importPath)
+	}
+	diffs := StringSet{}
+	diffs.Add("a/a.go")
+	impacted, _ := pathsImpacted(packages, indexPackages(packages), diffs, nil, resolve, projectDir)
+	if got, want := impacted.SortedSlice(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("impacted %q, want %q", got, want)
+	}
+	if all, _ := allPaths(packages, projectDir); !reflect.DeepEqual(all.SortedSlice(), []string{"a", "b"}) {
+		t.Errorf("allPaths = %q, want %q", all.SortedSlice(), []string{"a", "b"})
+	}
+}
+
+// Asset dirs beneath a package (eg: foo/migrations) are tested as the package that embeds or reads them.
+func TestAscendToPackages(t *testing.T) {
+	projectDir := canonicalPath(t.TempDir())
+	writeFiles(t, projectDir, map[string]string{
+		"foo/foo.go":                   "package foo\n",
+		"foo/migrations/001.sql":       "create table t (id int);\n",
+		"foo/assets/css/deep/site.css": "body {}\n",
+		"bar/bar.go":                   "package bar\n",
+		"static/index.html":            "<html></html>\n",
+		"foo/sub/sub.go":               "package sub\n",
+		"foo/sub/templates/page.tmpl":  "{{.}}\n",
+	})
+
+	paths, reasons := StringSet{}, Reasons{}
+	for _, path := range []string{"foo/migrations", "foo/assets/css/deep", "bar", "static", "foo/sub/templates"} {
+		path = filepath.FromSlash(path)
+		paths.Add(path)
+		reasons.Add(path, Reason{Kind: reasonChanged, Trigger: path})
+	}
+	ascendToPackages(paths, reasons, projectDir)
+
+	want := []string{"bar", "foo", filepath.Join("foo", "sub"), "static"}
+	if got := paths.SortedSlice(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ascended to %q, want %q", got, want)
+	}
+	if got := reasons["foo"].Trigger; got != filepath.FromSlash("foo/assets/css/deep") && got != filepath.FromSlash("foo/migrations") {
+		t.Errorf("foo impacted by %q, want one of its asset dirs", got)
+	}
+
+	// Without a package above it, an asset dir is left for pruning
+	removePathsWithoutBuildableGoFiles(paths, projectDir)
+	want = []string{"bar", "foo", filepath.Join("foo", "sub")}
+	if got := paths.SortedSlice(); !reflect.DeepEqual(got, want) {
+		t.Errorf("pruned to %q, want %q", got, want)
+	}
+}
+
+// With -moved-packages, importers still using the old import path of a moved package are impacted.
+func TestMovedPackageImporters(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"z/z.go": "package z\n",
+		"y/y.go": "package y\n\nimport _ \"example.com/fx/z\"\n",
+		"x/x.go": "package x\n",
+	})
+	run(t, projectDir, "git", "mv", "z", "a")
+	run(t, projectDir, "git", "commit", "-q", "-m", "move z to a")
+
+	diffs := gitAllDiffs("HEAD~1 HEAD", "", nil)
+	renames := gitRenames("HEAD~1 HEAD", nil)
+	if want := []rename{{from: "z/z.go", to: "a/z.go"}}; !reflect.DeepEqual(renames, want) {
+		t.Fatalf("renames = %v, want %v", renames, want)
+	}
+	packages, index, resolve := loadPackages("golist", []string{"./..."}, projectDir)
+
+	impacted, reasons := pathsImpacted(packages, index, diffs, renames, resolve, projectDir)
+	if got, want := impacted.SortedSlice(), []string{"a", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with renames impacted %q, want %q", got, want)
+	}
+	if reasons["y"].Kind != reasonDependency {
+		t.Errorf("y impacted as %q, want %q", reasons["y"].Kind, reasonDependency)
+	}
+
+	impacted, _ = pathsImpacted(packages, index, diffs, nil, resolve, projectDir)
+	if impacted.Exists("y") {
+		t.Errorf("without renames impacted %q, want no y", impacted.SortedSlice())
+	}
+}
+
+// -benchmarks-only keeps packages whose test files, internal or external, declare a Benchmark function.
+func TestPackagesWithBenchmarks(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"bench/bench.go":        "package bench\n",
+		"bench/bench_test.go":   "package bench\n\nimport \"testing\"\n\nfunc BenchmarkB(b *testing.B) {}\n",
+		"xbench/xbench.go":      "package xbench\n",
+		"xbench/x_test.go":      "package xbench_test\n\nimport \"testing\"\n\nfunc BenchmarkX(b *testing.B) {}\n",
+		"tests/tests.go":        "package tests\n",
+		"tests/tests_test.go":   "package tests\n\nimport \"testing\"\n\nfunc TestT(t *testing.T) {}\n\ntype T struct{}\n\nfunc (T) BenchmarkM(b *testing.B) {}\n",
+		"broken/broken.go":      "package broken\n",
+		"broken/broken_test.go": "package broken\n\nfunc {\n",
+		"none/none.go":          "package none\n",
+	})
+	packages, _, _ := loadPackages("golist", []string{"./..."}, projectDir)
+
+	want := map[string]bool{"bench": true, "xbench": true, "broken": true}
+	if got := packagesWithBenchmarks(packages, projectDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("packagesWithBenchmarks = %v, want %v", got, want)
+	}
+}
+
+/*
+  A package is impacted through what its tests import in turn: internal tests
+  importing b (which imports a), and an external test package importing a
+  shared test helper (which imports a).
+*/
+func TestTransitiveTestImports(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"a/a.go":               "package a\n",
+		"b/b.go":               "package b\n\nimport _ \"example.com/fx/a\"\n",
+		"c/c.go":               "package c\n",
+		"c/c_test.go":          "package c\n\nimport (\n\t\"testing\"\n\n\t_ \"example.com/fx/b\"\n)\n\nfunc TestC(t *testing.T) {}\n",
+		"testutil/testutil.go": "package testutil\n\nimport _ \"example.com/fx/a\"\n",
+		"d/d.go":               "package d\n",
+		"d/d_test.go":          "package d_test\n\nimport (\n\t\"testing\"\n\n\t_ \"example.com/fx/testutil\"\n)\n\nfunc TestD(t *testing.T) {}\n",
+		"e/e.go":               "package e\n",
+		"e/e_test.go":          "package e_test\n\nimport \"testing\"\n\nfunc TestE(t *testing.T) {}\n",
+	})
+
+	diffs := StringSet{}
+	diffs.Add("a/a.go")
+	want := []string{"a", "b", "c", "d", "testutil"}
+	for _, resolver := range []string{"golist", "gobuild"} {
+		if got := impactedPaths(t, resolver, diffs, projectDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s resolver: changing a/a.go impacted %q, want %q", resolver, got, want)
+		}
+	}
+}
+
+// The directory scans run against an fs.FS, so they are tested without touching disk.
+func TestDirectoryScans(t *testing.T) {
+	otherGOOS := "plan9"
+	if runtime.GOOS == otherGOOS {
+		otherGOOS = "linux"
+	}
+	fsys := fstest.MapFS{
+		"lib/lib.go":                       {},
+		"lib/lib_test.go":                  {},
+		"tested/only_test.go":              {},
+		"hidden/.lib_test.go":              {},
+		"hidden/_lib_test.go":              {},
+		"hidden/hidden.go":                 {},
+		"assets/site.css":                  {},
+		"assets/testdata/a.go":             {},
+		"lib/sub/sub.go":                   {},
+		"lib/sub/doc.txt":                  {},
+		"root_test.go":                     {},
+		"gated/gated_" + otherGOOS + ".go": {},
+		"gated/tagged.go":                  {Data: []byte("//go:build " + otherGOOS + "\n\npackage gated\n")},
+		"gated/doc.txt":                    {},
+	}
+	tests := []struct {
+		path          string
+		wantBuildable bool
+		wantTests     bool
+		wantMatches   bool
+	}{
+		{"lib", true, true, true},
+		{"tested", true, true, true},
+		{"hidden", true, false, true},
+		{"assets", false, false, false},
+		{filepath.Join("lib", "sub"), true, false, true},
+		{".", true, true, true},
+		{"deleted", false, false, false},
+		{"gated", true, false, false},
+	}
+	for _, test := range tests {
+		if got := hasBuildableGoFiles(fsys, test.path); got != test.wantBuildable {
+			t.Errorf("hasBuildableGoFiles(%q) = %v, want %v", test.path, got, test.wantBuildable)
+		}
+		if got := hasTestFiles(fsys, test.path); got != test.wantTests {
+			t.Errorf("hasTestFiles(%q) = %v, want %v", test.path, got, test.wantTests)
+		}
+		if got := matchesBuildContext(fsys, test.path); got != test.wantMatches {
+			t.Errorf("matchesBuildContext(%q) = %v, want %v", test.path, got, test.wantMatches)
+		}
+	}
+}
+
+/*
+  Import chains are followed through packages the patterns don't match: here
+  b is only listed as a dependency, between a (which imports it) and c.
+*/
+func TestNarrowedPatterns(t *testing.T) {
+	projectDir := gitFixture(t, map[string]string{
+		"a/a.go":      "package a\n\nimport _ \"example.com/fx/b\"\n",
+		"b/b.go":      "package b\n\nimport _ \"example.com/fx/c\"\n",
+		"c/c.go":      "package c\n",
+		"d/d.go":      "package d\n",
+		"d/d_test.go": "package d\n\nimport (\n\t\"testing\"\n\n\t_ \"example.com/fx/b\"\n)\n\nfunc TestD(t *testing.T) {}\n",
+		"e/e.go":      "package e\n\nimport _ \"example.com/fx/b\"\n",
+	})
+	oldDepth := *depth
+	t.Cleanup(func() { *depth = oldDepth })
+
+	packages, index, resolve := loadPackages("golist", []string{"./a/...", "./c/...", "./d/...", "./e/..."}, projectDir)
+	diffs := StringSet{}
+	diffs.Add("c/c.go")
+	for _, d := range []int{-1, 5, 2} {
+		*depth = d
+		impacted, _ := pathsImpacted(packages, index, diffs, nil, resolve, projectDir)
+		if got, want := impacted.SortedSlice(), []string{"a", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("-depth=%d: impacted %q, want %q", d, got, want)
+		}
+	}
+	*depth = 1
+	impacted, _ := pathsImpacted(packages, index, diffs, nil, resolve, projectDir)
+	if got, want := impacted.SortedSlice(), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-depth=1: impacted %q, want %q", got, want)
+	}
+
+	// Only d has tests, which need b and so c. Nothing tested needs a or e.
+	*depth = -1
+	impacted, _ = pathsImpacted(packages, index, diffs, nil, resolve, projectDir)
+	removeUntestedNonDeps(impacted, packages, index, projectDir)
+	if got, want := impacted.SortedSlice(), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-exclude-no-test-deps: impacted %q, want %q", got, want)
+	}
+}
+
+// A module replaced with a local directory is part of the diff like any other, so editing it impacts its importers.
+func TestReplacedLocalModule(t *testing.T) {
+	setClassifyFlags(t, stringsFlag{"testdata"}, nil)
+	projectDir := gitFixture(t, map[string]string{
+		"go.mod":          "module example.com/fx\n\ngo 1.20\n\nrequire example.com/localmod v0.0.0\n\nreplace example.com/localmod => ./localmod\n",
+		"localmod/go.mod": "module example.com/localmod\n\ngo 1.20\n",
+		"localmod/lm.go":  "package localmod\n",
+		"a/a.go":          "package a\n\nimport _ \"example.com/localmod\"\n",
+		"b/b.go":          "package b\n",
+	})
+
+	diffs := StringSet{}
+	diffs.Add("localmod/lm.go")
+	want := []string{"a", "localmod"}
+	for _, resolver := range []string{"golist", "gobuild"} {
+		if got := impactedPaths(t, resolver, diffs, projectDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s resolver: changing localmod/lm.go impacted %q, want %q", resolver, got, want)
+		}
+	}
+}
+
+// Test files that don't build on this platform don't count as tests.
+func TestPlatformGatedTests(t *testing.T) {
+	otherGOOS := "plan9"
+	if runtime.GOOS == otherGOOS {
+		otherGOOS = "linux"
+	}
+	projectDir := gitFixture(t, map[string]string{
+		"gated/gated.go":       "package gated\n",
+		"gated/gated_test.go":  "//go:build " + otherGOOS + "\n\npackage gated\n\nimport \"testing\"\n\nfunc TestGated(t *testing.T) {}\n",
+		"tested/tested.go":     "package tested\n",
+		"tested/x_test.go":     "package tested_test\n\nimport \"testing\"\n\nfunc TestX(t *testing.T) {}\n",
+		"untested/untested.go": "package untested\n",
+	})
+	packages, _, _ := loadPackages("golist", []string{"./..."}, projectDir)
+
+	want := map[string]bool{"gated": false, "tested": true, "untested": false}
+	if got := packagesWithTests(packages, projectDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("packagesWithTests = %v, want %v", got, want)
+	}
+
+	paths := StringSet{}
+	paths.Add("gated", "tested", "untested")
+	removePathsWithoutTests(paths, packages, projectDir)
+	if got, want := paths.SortedSlice(), []string{"tested"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-with-tests-only kept %q, want %q", got, want)
+	}
+}
+
+// -classify applies the assembly rule of pathsImpacted with go/build, which must agree with go list.
+func TestDirHasAssembly(t *testing.T) {
+	otherGOARCH := "s390x"
+	if runtime.GOARCH == otherGOARCH {
+		otherGOARCH = "amd64"
+	}
+	projectDir := gitFixture(t, map[string]string{
+		"asm/asm.go":                        "package asm\n",
+		"asm/asm.s":                         "",
+		"gated/gated.go":                    "package gated\n",
+		"gated/gated_" + otherGOARCH + ".s": "",
+		"syso/syso.go":                      "package syso\n",
+		"syso/rsrc.syso":                    "",
+		"plain/plain.go":                    "package plain\n",
+		"nogo/x.s":                          "",
+	})
+	packages, _, _ := loadPackages("golist", []string{"./..."}, projectDir)
+	assembled := packagesWithAssembly(packages, projectDir)
+	for _, dir := range []string{"asm", "gated", "syso", "plain", "nogo"} {
+		if got, want := dirHasAssembly(projectDir, dir), assembled[dir]; got != want {
+			t.Errorf("dirHasAssembly(%q) = %v, but go list says %v", dir, got, want)
+		}
+	}
+	if !assembled["asm"] || !assembled["syso"] || assembled["gated"] {
+		t.Errorf("packagesWithAssembly = %v, want asm and syso only", assembled)
+	}
+}
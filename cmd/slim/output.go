@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The values accepted by -format.
+var formats = map[string]bool{
+	"text":              true,
+	"make":              true,
+	"github-actions":    true,
+	"json":              true,
+	"line":              true,
+	"jsonl":             true,
+	"null-json":         true,
+	"gotest":            true,
+	"govet":             true,
+	"env":               true,
+	"by-module":         true,
+	"importpath":        true,
+	"test-binaries":     true,
+	"text-with-reasons": true,
+	"files":             true,
+}
+
+func formatNames() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Everything known about the impacted paths that the formats may need.
+type report struct {
+	projectDir  string
+	cwd         string
+	paths       []string          // relative to projectDir
+	importPaths map[string]string // keyed by path
+	modules     map[string]Module // with an absolute Dir, keyed by path, filled in by moduleOf
+	reasons     Reasons           // keyed by path
+	diffs       StringSet         // changed files, relative to projectDir
+}
+
+// A structured description of an impacted package, used by the JSON based formats.
+type record struct {
+	Dir        string   `json:"dir"`
+	ImportPath string   `json:"importPath"`
+	Reason     string   `json:"reason"`
+	Deps       []string `json:"deps,omitempty"`
+}
+
+/*
+  Writes the impacted paths to w in the format selected by -format. Paths
+  are printed relative to the directory chosen by -path-base:
+
+    text
+      One "./<path>" per line, suitable for `go test $(slim)`.
+
+    line
+      All the paths on a single line, separated by spaces, to interpolate into
+      a command. Nothing is printed when no paths are impacted. Paths aren't
+      quoted, so use env when they may contain spaces.
+
+    text-with-reasons
+      For people reading CI logs: one impacted path per line, aligned with
+      the reason it was impacted (as in the json records) and what triggered
+      it, ie: the changed file, altered dependency or -always glob:
+        ./a  changed     ./a/a.go
+        ./b  dependency  ./a
+
+    test-binaries
+      Like text, but only for packages with test files, ie: those that `go
+      test` builds a test binary for. Applied before -shards, so each shard
+      gets a balanced share of test binaries.
+
+    make
+      A single Makefile assignment of the impacted import paths:
+        PACKAGES := <importpath> <importpath> ...
+
+    github-actions
+      A "::notice::" workflow command per impacted path, plus a
+      "packages=<path> <path> ..." step output appended to the file named by
+      $GITHUB_OUTPUT. Falls back to text when $GITHUB_OUTPUT is unset.
+
+    json
+      An indented JSON array of {"dir", "importPath", "reason"} records.
+
+    jsonl
+      The same records, one compact JSON object per line.
+
+    null-json
+      The same records as compact JSON objects, each one followed by a NUL
+      byte. Readers split the output on "\x00", drop the final empty chunk and
+      json.Unmarshal each remaining chunk.
+
+    gotest
+      A single `go test` command line for the impacted paths. With -cover the
+      command also measures coverage of just the impacted packages:
+        go test -cover -coverpkg=<importpath>,<importpath> <path> <path>
+      With -coverprofile each command also writes a coverage profile, named
+      apart per shard and tag set (see coverProfileName):
+        go test -cover -coverpkg=<importpath> -coverprofile='cover.out' <path>
+      With -benchmarks-only it runs the benchmarks and skips the tests:
+        go test -run='^$' -bench=. <path> <path>
+      With -split-test-tags there is one command per set of build tags the
+      impacted tests need:
+        go test <path> <path>
+        go test -tags=integration <path>
+      Nothing is printed when no paths are impacted.
+
+    govet
+      A single `go vet` command line for the impacted import paths, with the
+      space separated -vet-flags (eg: analyzer flags) before them:
+        go vet -printf=false example.com/a example.com/b
+      Nothing is printed when no paths are impacted.
+
+    env
+      A single shell variable assignment, named by -env-var, of the
+      space separated paths, quoted so it can be eval'd or sourced as is:
+        SLIM_PACKAGES='./a ./b'
+      The value is '' when no paths are impacted.
+
+    by-module
+      A JSON object mapping the directory of each module containing impacted
+      packages to their paths relative to that module's root, so `go test` can
+      be run from within each module:
+        {"./tools": ["./lint"], "./.": ["./a", "./b"]}
+      Paths outside of any module are grouped under the project root.
+
+    files
+      A JSON object mapping each impacted path to the changed files directly
+      inside it. Paths impacted only as dependents or by testdata have an
+      empty list, or are left out with -files-omit-empty:
+        {"./a": ["./a/a.go"], "./b": []}
+
+    importpath
+      One import path per line. With -importpath-style=module-relative each
+      package is printed relative to the root of its own module (the nearest
+      go.mod), so nested modules aren't mixed up with the outer one:
+        full              example.com/tools/lint
+        module-relative   ./lint
+*/
+func printImpacted(w io.Writer, r report) {
+	switch *format {
+	case "text", "test-binaries":
+		if !*includeDepsInOutput {
+			printLines(w, r.displayPaths())
+			return
+		}
+		for _, path := range r.paths {
+			if deps := r.displayDeps(path); len(deps) > 0 {
+				fmt.Fprintf(w, "%s # depends on altered %s\n", r.displayPath(path), strings.Join(deps, " "))
+			} else {
+				fmt.Fprintln(w, r.displayPath(path))
+			}
+		}
+	case "line":
+		if len(r.paths) > 0 {
+			fmt.Fprintln(w, strings.Join(r.displayPaths(), " "))
+		}
+	case "text-with-reasons":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, path := range r.paths {
+			reason := r.reasons[path]
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.displayPath(path), reason.Kind, r.displayTrigger(reason))
+		}
+		check(tw.Flush())
+	case "make":
+		fmt.Fprintln(w, strings.TrimSpace("PACKAGES := "+strings.Join(r.toImportPaths(), " ")))
+	case "github-actions":
+		outputFile := os.Getenv("GITHUB_OUTPUT")
+		if outputFile == "" {
+			printLines(w, r.displayPaths())
+			return
+		}
+		for _, path := range r.displayPaths() {
+			fmt.Fprintf(w, "::notice::impacted package %s\n", path)
+		}
+		f, err := os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		check(err)
+		defer f.Close()
+		_, err = fmt.Fprintf(f, "packages=%s\n", strings.Join(r.displayPaths(), " "))
+		check(err)
+	case "json":
+		check(printJSON(w, r.toRecords()))
+	case "jsonl", "null-json":
+		delim := "\n"
+		if *format == "null-json" {
+			delim = "\x00"
+		}
+		for _, rec := range r.toRecords() {
+			b, err := json.Marshal(rec)
+			check(err)
+			fmt.Fprint(w, string(b)+delim)
+		}
+	case "gotest":
+		if len(r.paths) == 0 {
+			return
+		}
+		args := []string{"go", "test"}
+		if *cover {
+			args = append(args, "-cover", "-coverpkg="+strings.Join(r.toImportPaths(), ","))
+		}
+		if *benchmarksOnly {
+			args = append(args, "-run='^$'", "-bench=.")
+		}
+		if !*splitTestTags {
+			if *coverProfile != "" {
+				args = append(args, "-coverprofile="+shellQuote(coverProfileName(*coverProfile, "", *shard, *shards)))
+			}
+			fmt.Fprintln(w, strings.Join(append(args, r.displayPaths()...), " "))
+			return
+		}
+		byTags := r.pathsByTestTags()
+		var tagSets []string
+		for tags := range byTags {
+			tagSets = append(tagSets, tags)
+		}
+		sort.Strings(tagSets)
+		for _, tags := range tagSets {
+			cmd := args
+			if tags != "" {
+				cmd = append(cmd[:len(cmd):len(cmd)], "-tags="+tags)
+			}
+			if *coverProfile != "" {
+				cmd = append(cmd[:len(cmd):len(cmd)], "-coverprofile="+shellQuote(coverProfileName(*coverProfile, tags, *shard, *shards)))
+			}
+			fmt.Fprintln(w, strings.Join(append(cmd[:len(cmd):len(cmd)], byTags[tags]...), " "))
+		}
+	case "govet":
+		if len(r.paths) == 0 {
+			return
+		}
+		args := append([]string{"go", "vet"}, strings.Fields(*vetFlags)...)
+		fmt.Fprintln(w, strings.Join(append(args, r.toImportPaths()...), " "))
+	case "env":
+		fmt.Fprintf(w, "%s=%s\n", *envVar, shellQuote(strings.Join(r.displayPaths(), " ")))
+	case "by-module":
+		check(printJSON(w, r.byModule()))
+	case "files":
+		check(printJSON(w, r.filesByPath()))
+	case "importpath":
+		if *importPathStyle == "module-relative" {
+			printLines(w, r.toModuleRelativePaths())
+		} else {
+			printLines(w, r.toImportPaths())
+		}
+	}
+}
+
+// Maps each displayed path to the displayed changed files directly inside it.
+func (r report) filesByPath() map[string][]string {
+	files := map[string][]string{}
+	for _, path := range r.paths {
+		changed := []string{}
+		for _, file := range r.diffs.SortedSlice() {
+			if filepath.Dir(filepath.FromSlash(file)) == path {
+				changed = append(changed, r.displayPath(filepath.FromSlash(file)))
+			}
+		}
+		if len(changed) > 0 || !*filesOmitEmpty {
+			files[r.displayPath(path)] = changed
+		}
+	}
+	return files
+}
+
+/*
+  Groups the displayed paths by the build tags (see testTags) of the tests that
+  need running. A changed test file only impacts the tests sharing its tags,
+  while any other reason for impact only runs the tests compiled without tags.
+*/
+func (r report) pathsByTestTags() map[string][]string {
+	byTags := map[string][]string{}
+	for _, path := range r.paths {
+		tagSets := StringSet{}
+		if r.reasons[path].Kind != reasonTest {
+			tagSets.Add("")
+		}
+		for _, file := range r.diffs.SortedSlice() {
+			file = filepath.FromSlash(file)
+			if filepath.Dir(file) == path && strings.HasSuffix(file, "_test.go") {
+				tagSets.Add(testTags(r.projectDir, file))
+			}
+		}
+		for tags := range tagSets {
+			byTags[tags] = append(byTags[tags], r.displayPath(path))
+		}
+	}
+	return byTags
+}
+
+// Groups the paths by the displayed directory of their module, with each path made relative to its module root.
+func (r report) byModule() map[string][]string {
+	modules := map[string][]string{}
+	for _, path := range r.paths {
+		moduleDir := r.projectDir
+		if module, ok := r.moduleOf(path); ok {
+			moduleDir = module.Dir
+		}
+		rel, err := filepath.Rel(moduleDir, filepath.Join(r.projectDir, path))
+		check(err)
+		moduleRel, err := relToRoot(r.projectDir, moduleDir)
+		check(err)
+		key := r.displayPath(moduleRel)
+		modules[key] = append(modules[key], "."+sep+rel)
+	}
+	return modules
+}
+
+/*
+  Names the coverage profile of one go test invocation after the -coverprofile
+  file, inserting the shard (when sharded) and the tag set before the
+  extension, so no two invocations write the same file: cover.out becomes eg:
+  cover.shard1.integration.out.
+*/
+func coverProfileName(file, tags string, shard, shards int) string {
+	ext := filepath.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	if shards > 1 {
+		name += fmt.Sprintf(".shard%d", shard)
+	}
+	if tags != "" {
+		name += "." + strings.Replace(tags, ",", "-", -1)
+	}
+	return name + ext
+}
+
+// Quotes s for a POSIX shell, so spaces and other special characters are taken literally.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Reports whether name can be used as a shell variable name.
+func validEnvVar(name string) bool {
+	for i, r := range name {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !(i > 0 && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func (r report) toRecords() []record {
+	records := make([]record, len(r.paths))
+	for i, path := range r.paths {
+		records[i] = record{
+			Dir:        r.displayPath(path),
+			ImportPath: r.importPaths[path],
+			Reason:     r.reasons[path].Kind,
+		}
+		if *includeDepsInOutput {
+			records[i].Deps = r.displayDeps(path)
+		}
+	}
+	return records
+}
+
+// Displays what triggered a reason: a path like any other, except for -always globs which are shown as given.
+func (r report) displayTrigger(reason Reason) string {
+	switch reason.Kind {
+	case reasonAll:
+		return ""
+	case reasonAlways:
+		return reason.Trigger
+	}
+	return r.displayPath(filepath.FromSlash(reason.Trigger))
+}
+
+// Displays the paths of the altered dependencies that impacted path.
+func (r report) displayDeps(path string) []string {
+	var deps []string
+	for _, dep := range r.reasons[path].Deps {
+		deps = append(deps, r.displayPath(dep))
+	}
+	return deps
+}
+
+// Reads a -baseline-file: one path per line, as the text format prints them. Blank lines are skipped.
+func readBaseline(file string) (StringSet, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	baseline := StringSet{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			baseline.Add(line)
+		}
+	}
+	return baseline, nil
+}
+
+// Returns the displayed paths missing from the baseline (added) and the baseline paths no longer displayed (removed).
+func compareBaseline(baseline StringSet, paths []string) ([]string, []string) {
+	current := StringSet{}
+	current.Add(paths...)
+	var added, removed []string
+	for _, path := range current.SortedSlice() {
+		if !baseline.Exists(path) {
+			added = append(added, path)
+		}
+	}
+	for _, path := range baseline.SortedSlice() {
+		if !current.Exists(path) {
+			removed = append(removed, path)
+		}
+	}
+	return added, removed
+}
+
+// Drops the newline or NUL that ends the last entry of the output, for -output-trailing-newline=false.
+func trimTrailingDelimiter(output []byte) []byte {
+	if n := len(output); n > 0 && (output[n-1] == '\n' || output[n-1] == 0) {
+		return output[:n-1]
+	}
+	return output
+}
+
+func printLines(w io.Writer, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+/*
+  Formats a path (relative to the project root) for output, according to
+  -path-base. Relative paths are always prefixed with "./" or "../" so the go
+  tool treats them as package paths rather than import paths:
+
+    root
+      Relative to the project root, eg: "./foo/bar"
+
+    cwd
+      Relative to the working directory, eg: "../foo/bar" from within baz/
+
+    absolute
+      Joined onto the project root, eg: "/src/project/foo/bar". The root is
+      symlink-free, like the package dirs slim compares with go list's.
+*/
+func (r report) displayPath(path string) string {
+	switch *pathBase {
+	case "absolute":
+		return filepath.Join(r.projectDir, path)
+	case "cwd":
+		rel, err := filepath.Rel(r.cwd, filepath.Join(r.projectDir, path))
+		check(err)
+		if rel == "." || strings.HasPrefix(rel, ".."+sep) || rel == ".." {
+			return rel
+		}
+		return "." + sep + rel
+	default:
+		return "." + sep + path
+	}
+}
+
+func (r report) displayPaths() []string {
+	converted := make([]string, len(r.paths))
+	for i, path := range r.paths {
+		converted[i] = r.displayPath(path)
+	}
+	return converted
+}
+
+/*
+  Maps each path to its import path with the module path stripped, eg:
+  "./lint" for example.com/tools/lint in module example.com/tools. Falls back
+  to the displayed path for directories outside of any module.
+*/
+func (r report) toModuleRelativePaths() []string {
+	converted := make([]string, len(r.paths))
+	for i, path := range r.paths {
+		module, ok := r.moduleOf(path)
+		if !ok {
+			converted[i] = r.displayPath(path)
+			continue
+		}
+		rel, err := filepath.Rel(module.Dir, filepath.Join(r.projectDir, path))
+		check(err)
+		if rel == "." {
+			converted[i] = "."
+		} else {
+			converted[i] = "./" + filepath.ToSlash(rel)
+		}
+	}
+	return converted
+}
+
+// Maps each path to its import path, falling back to the displayed path for directories go list didn't report.
+func (r report) toImportPaths() []string {
+	converted := make([]string, len(r.paths))
+	for i, path := range r.paths {
+		if importPath, ok := r.importPaths[path]; ok {
+			converted[i] = importPath
+		} else {
+			converted[i] = r.displayPath(path)
+		}
+	}
+	return converted
+}
+
+/*
+  Finds the module containing path (relative to the project root) from the
+  nearest go.mod at or above it, up to the project root. go list can't be
+  asked instead: run from the outer module, it doesn't report the packages of
+  nested modules (eg: tools/go.mod) at all. Reports false outside of any
+  module.
+*/
+func (r report) moduleOf(path string) (Module, bool) {
+	if module, ok := r.modules[path]; ok {
+		return module, module.Dir != ""
+	}
+	var module Module
+	for dir := filepath.Join(r.projectDir, path); ; dir = filepath.Dir(dir) {
+		if gomod, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			module = Module{Path: modulePath(gomod), Dir: dir}
+			break
+		}
+		if dir == r.projectDir || !isWithin(r.projectDir, dir) {
+			break
+		}
+	}
+	r.modules[path] = module
+	return module, module.Dir != ""
+}
+
+// Returns the module path declared by the contents of a go.mod file.
+func modulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "\"`")
+		}
+	}
+	return ""
+}
+
+// Indexes packages by their directory relative to the project root.
+func importPathsByDir(packages []Package, projectDir string) map[string]string {
+	importPaths := map[string]string{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		importPaths[rel] = pkg.ImportPath
+	}
+	return importPaths
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCoverProfileName(t *testing.T) {
+	tests := []struct {
+		file   string
+		tags   string
+		shard  int
+		shards int
+		want   string
+	}{
+		{"cover.out", "", 0, 1, "cover.out"},
+		{"cover.out", "integration", 0, 1, "cover.integration.out"},
+		{"cover.out", "e2e,integration", 0, 1, "cover.e2e-integration.out"},
+		{"cover.out", "", 1, 3, "cover.shard1.out"},
+		{"cover.out", "integration", 2, 3, "cover.shard2.integration.out"},
+		{"out/cover", "integration", 0, 1, "out/cover.integration"},
+	}
+	for _, test := range tests {
+		if got := coverProfileName(test.file, test.tags, test.shard, test.shards); got != test.want {
+			t.Errorf("coverProfileName(%q, %q, %d, %d) = %q, want %q", test.file, test.tags, test.shard, test.shards, got, test.want)
+		}
+	}
+}
+
+// The outer module's go list doesn't report nested modules, so they're found from their go.mod files.
+func TestNestedModules(t *testing.T) {
+	projectDir := canonicalPath(t.TempDir())
+	writeFiles(t, projectDir, map[string]string{
+		"go.mod":             "module example.com/fx\n\ngo 1.20\n",
+		"main.go":            "package main\n",
+		"a/a.go":             "package a\n",
+		"tools/go.mod":       "// The linters\nmodule \"example.com/tools\" // quoted\n\ngo 1.20\n",
+		"tools/tools.go":     "package tools\n",
+		"tools/lint/lint.go": "package lint\n",
+	})
+	r := report{
+		projectDir:  projectDir,
+		cwd:         projectDir,
+		paths:       []string{".", "a", "tools", filepath.Join("tools", "lint")},
+		importPaths: map[string]string{".": "example.com/fx", "a": "example.com/fx/a"},
+		modules:     map[string]Module{},
+	}
+
+	wantByModule := map[string][]string{
+		"./.":     {"./.", "./a"},
+		"./tools": {"./.", "./lint"},
+	}
+	if got := r.byModule(); !reflect.DeepEqual(got, wantByModule) {
+		t.Errorf("byModule = %q, want %q", got, wantByModule)
+	}
+	if got, want := r.toModuleRelativePaths(), []string{".", "./a", ".", "./lint"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("toModuleRelativePaths = %q, want %q", got, want)
+	}
+	if module, _ := r.moduleOf(filepath.Join("tools", "lint")); module.Path != "example.com/tools" {
+		t.Errorf("moduleOf(tools/lint).Path = %q, want %q", module.Path, "example.com/tools")
+	}
+
+	// Outside of any module, paths fall back to being displayed as is
+	outside := canonicalPath(t.TempDir())
+	writeFiles(t, outside, map[string]string{"src/p/p.go": "package p\n"})
+	r = report{projectDir: outside, cwd: outside, paths: []string{filepath.Join("src", "p")}, modules: map[string]Module{}}
+	if got, want := r.toModuleRelativePaths(), []string{"./src/p"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("outside a module: toModuleRelativePaths = %q, want %q", got, want)
+	}
+}
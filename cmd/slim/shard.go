@@ -0,0 +1,52 @@
+package main
+
+import "sort"
+
+/*
+  Deterministically partitions paths into n shards and returns shard k (0
+  based). Paths are weighted by their number of test files (at least 1), then
+  assigned heaviest first to whichever shard has the least weight so far, so
+  shards take roughly the same time to test. Every path lands in exactly one
+  shard.
+*/
+func shardPaths(paths []string, packages []Package, projectDir string, n, k int) []string {
+	weights := map[string]int{}
+	for _, pkg := range packages {
+		rel, err := relToRoot(projectDir, pkg.Dir)
+		if err != nil {
+			continue
+		}
+		weights[rel] = len(pkg.TestGoFiles) + len(pkg.XTestGoFiles)
+	}
+	weight := func(path string) int {
+		if weights[path] < 1 {
+			return 1
+		}
+		return weights[path]
+	}
+
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if weight(sorted[i]) != weight(sorted[j]) {
+			return weight(sorted[i]) > weight(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	loads := make([]int, n)
+	var shard []string
+	for _, path := range sorted {
+		lightest := 0
+		for i := range loads {
+			if loads[i] < loads[lightest] {
+				lightest = i
+			}
+		}
+		loads[lightest] += weight(path)
+		if lightest == k {
+			shard = append(shard, path)
+		}
+	}
+	sort.Strings(shard)
+	return shard
+}
@@ -1,3 +1,3 @@
 module github.com/kevin-cantwell/slim
 
-go 1.12
+go 1.20